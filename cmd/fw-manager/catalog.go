@@ -0,0 +1,184 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/state"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// stdoutPath makes the catalog dump written to the standard output
+const stdoutPath = "-"
+
+// runCatalog runs the catalog subcommands.
+//
+// Usage:
+//
+//	fw-manager [global flags] catalog dump [--output <file>] [--gzip]
+//	fw-manager [global flags] catalog conflicts
+func runCatalog(ctx context.Context, cmdArgs []string) error {
+	if len(cmdArgs) == 0 {
+		return fmt.Errorf("missing catalog command, available commands: dump, conflicts")
+	}
+
+	switch cmdArgs[0] {
+	case "dump":
+		return runCatalogDump(ctx, cmdArgs[1:])
+	case "conflicts":
+		return runCatalogConflicts(ctx)
+	default:
+		return fmt.Errorf("unknown catalog command %q, available commands: dump, conflicts", cmdArgs[0])
+	}
+}
+
+// runCatalogConflicts prints consul instances which classification strategies disagree about their fleet type
+func runCatalogConflicts(ctx context.Context) error {
+	config, err := readConfigFile(args.configFilePath)
+	if err != nil {
+		return err
+	}
+
+	classifier, err := newClassifier(config.Classification)
+	if err != nil {
+		return err
+	}
+
+	var services []*consulapi.CatalogService
+	if args.consulCatalogFilePath != "" {
+		services, err = consul.ReadLocalCatalog(args.consulCatalogFilePath)
+	} else {
+		services, err = fetchRawCatalog(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	conflicts := classifier.Conflicts(services)
+	for _, conflict := range conflicts {
+		fmt.Println(conflict)
+	}
+	log.Printf("Found %d classification conflicts in %d instances", len(conflicts), len(services))
+
+	return nil
+}
+
+// fetchRawCatalog fetches the catalog of all data-centers from consul, instances are not filtered by health
+func fetchRawCatalog(ctx context.Context) ([]*consulapi.CatalogService, error) {
+	healthThreshold, err := consul.ParseHealthThreshold(args.consulHealth)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockCatalogCache()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	consulApi, err := newConsulAPIClient(healthThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	fleetCatalog, err := fetchFleetCatalog(ctx, consulApi)
+	if err != nil {
+		return nil, err
+	}
+
+	return fleetCatalog.Services, nil
+}
+
+// runCatalogDump fetches the catalog of all data-centers and writes it in the format accepted
+// by the --consul-catalog-file-path, together with the fetch metadata
+func runCatalogDump(ctx context.Context, cmdArgs []string) error {
+	flags := flag.NewFlagSet("catalog dump", flag.ExitOnError)
+	output := flags.String("output", stdoutPath, "File the catalog is written to, - writes to the standard output")
+	compress := flags.Bool("gzip", false, "Compress the catalog with gzip, enabled for the output with the .gz extension")
+	if err := flags.Parse(cmdArgs); err != nil {
+		return err
+	}
+
+	healthThreshold, err := consul.ParseHealthThreshold(args.consulHealth)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockCatalogCache()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	consulApi, err := newConsulAPIClient(healthThreshold)
+	if err != nil {
+		return err
+	}
+
+	fleetCatalog, err := fetchFleetCatalog(ctx, consulApi)
+	if err != nil {
+		return err
+	}
+	if len(fleetCatalog.CachedDatacenters) > 0 {
+		log.Printf("WARNING: the dump contains the cached catalog of: %v", fleetCatalog.CachedDatacenters)
+	}
+
+	dump := consul.NewCatalogDump(fleetCatalog, time.Now())
+	compressed := *compress || strings.HasSuffix(*output, ".gz")
+	if *output == stdoutPath {
+		return writeCatalogDump(os.Stdout, dump, compressed)
+	}
+
+	if err := writeCatalogDumpFile(*output, dump, compressed); err != nil {
+		return err
+	}
+	log.Printf("Catalog of %d instances written to %s", len(dump.Services), *output)
+
+	return nil
+}
+
+// lockCatalogCache takes the lock before the catalog cache in the state directory is read or written,
+// so it is never mixed with the run applying rules. Nil lock is returned when the cache is disabled.
+func lockCatalogCache() (*state.Lock, error) {
+	if args.catalogMaxAge <= 0 {
+		return nil, nil
+	}
+
+	lock, err := state.AcquireLock(args.stateDir, args.lockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+
+	return lock, nil
+}
+
+func writeCatalogDump(w io.Writer, dump consul.CatalogDump, compressed bool) error {
+	if !compressed {
+		return consul.WriteCatalogDump(w, dump)
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	if err := consul.WriteCatalogDump(gzipWriter, dump); err != nil {
+		return err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to compress catalog dump: %w", err)
+	}
+
+	return nil
+}
+
+// writeCatalogDumpFile writes the dump to the file, the file is never left half written
+func writeCatalogDumpFile(filePath string, dump consul.CatalogDump, compressed bool) error {
+	return state.WriteFileAtomic(filePath, func(w io.Writer) error {
+		return writeCatalogDump(w, dump, compressed)
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/discovery"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the content of the --config file. Flags override settings from the file.
+//
+// Example:
+//
+//	consul:
+//	  address: https://127.0.0.1:8501
+//	  ca_file: /etc/consul.d/tls/ca.pem
+//	  cert_file: /etc/consul.d/tls/client.pem
+//	  key_file: /etc/consul.d/tls/client-key.pem
+//	  token_file: /etc/fw-manager/consul-token
+//	  namespace: infra
+//	  partition: eu
+//	sources:
+//	  - type: consul
+//	  - type: inventory
+//	    path: /etc/fw-manager/inventory.yaml
+//	    filter:
+//	      network: 10.10.0.0/16
+//	  - type: dns
+//	    resolver: 10.0.0.2:53
+//	    records:
+//	      - name: _wireguard._udp.metrics.prod.example.com
+//	        type: metrics
+//	classification:
+//	  - strategy: tags
+//	  - strategy: node-meta
+//	    key: env
+//	  - strategy: node-name
+//	    pattern: '^node-\d+\.[^.]+\.(?P<type>[^.]+)\.[^.]+$'
+type fileConfig struct {
+	Consul consul.ClientConfig `yaml:"consul"`
+	// Sources the fleet is discovered from, in the priority order. Consul only when empty.
+	Sources []sourceConfig `yaml:"sources"`
+	// Classification strategies of consul instances, in the priority order. Tags only when empty.
+	Classification []classificationConfig `yaml:"classification"`
+}
+
+// classificationConfig configures one classification strategy, fields depend on the strategy
+type classificationConfig struct {
+	// Strategy is one of: tags, node-meta, node-name
+	Strategy string `yaml:"strategy"`
+	// Key of the node-meta strategy
+	Key string `yaml:"key"`
+	// Pattern of the node-name strategy, with the `type` named group
+	Pattern string `yaml:"pattern"`
+}
+
+// sourceConfig configures one catalog source, fields depend on the type
+type sourceConfig struct {
+	// Type is one of: consul, consul-file, inventory, dns
+	Type string `yaml:"type"`
+	// Path of the consul-file or the inventory file
+	Path string `yaml:"path"`
+	// Resolver and Records of the dns source
+	Resolver string                `yaml:"resolver"`
+	Records  []discovery.DNSRecord `yaml:"records"`
+	// Filter selects items of the source on the client side
+	Filter *discovery.FilterConfig `yaml:"filter"`
+}
+
+func readConfigFile(filePath string) (*fileConfig, error) {
+	result := &fileConfig{}
+	if filePath == "" {
+		return result, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(result); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", filePath, err)
+	}
+
+	return result, nil
+}
+
+// consulClientConfig returns the consul connection from the config file overridden by flags
+func consulClientConfig() (consul.ClientConfig, error) {
+	config, err := readConfigFile(args.configFilePath)
+	if err != nil {
+		return consul.ClientConfig{}, err
+	}
+
+	return config.Consul.Merge(args.consulClient), nil
+}
+
+// newClassifier returns the classifier with strategies from the config file
+func newClassifier(configs []classificationConfig) (*consul.Classifier, error) {
+	if len(configs) == 0 {
+		return consul.DefaultClassifier(), nil
+	}
+
+	strategies := make([]consul.ClassificationStrategy, 0, len(configs))
+	for idx, config := range configs {
+		switch config.Strategy {
+		case "tags":
+			strategies = append(strategies, consul.TagsStrategy{})
+		case "node-meta":
+			if config.Key == "" {
+				return nil, fmt.Errorf("invalid classification strategy %d: the node-meta strategy requires the key", idx)
+			}
+			strategies = append(strategies, consul.NodeMetaStrategy{Key: config.Key})
+		case "node-name":
+			strategy, err := consul.NewNodeNameStrategy(config.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid classification strategy %d: %w", idx, err)
+			}
+			strategies = append(strategies, strategy)
+		default:
+			return nil, fmt.Errorf("invalid classification strategy %d: unknown strategy %q, expected one of: tags, node-meta, node-name", idx, config.Strategy)
+		}
+	}
+
+	return consul.NewClassifier(strategies...), nil
+}
+
+// consulNormalizer returns the normalizer of consul catalogs configured in the config file
+func consulNormalizer() (*consul.Normalizer, error) {
+	config, err := readConfigFile(args.configFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	classifier, err := newClassifier(config.Classification)
+	if err != nil {
+		return nil, err
+	}
+
+	addressPolicy, err := consul.ParseAddressPolicy(args.addressPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	_, network, err := net.ParseCIDR(args.networkCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the network CIDR: %w", err)
+	}
+
+	normalizer := consul.NewNormalizer()
+	normalizer.SetClassifier(classifier)
+	normalizer.SetAddressPolicy(addressPolicy)
+	normalizer.SetNetwork(network)
+	normalizer.SetStrict(args.strictCatalog)
+
+	return normalizer, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+
+	"github.com/daniel1302/fw-manager/system"
+)
+
+// ipsetRun is the ipset part of the run. It is prepared before any change is applied.
+type ipsetRun struct {
+	manager  *system.IPSetManager
+	existing []system.IPSet
+	desired  []system.IPSet
+	plan     system.IPSetExecutionPlan
+	// cleanup is set when the ipset mode is disabled and sets left by previous runs are destroyed
+	cleanup bool
+}
+
+// prepareIPSets compares managed ipsets with the desired sets
+func prepareIPSets(desiredSets []system.IPSet, rulePlacement system.RulePlacement) (*ipsetRun, error) {
+	ipsetManager, err := system.NewIPSetManager(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ipset manager: %w", err)
+	}
+	ipsetManager.SetPlacement(rulePlacement)
+
+	existingSets, err := ipsetManager.ListManagedSets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list managed ipsets: %w", err)
+	}
+
+	return &ipsetRun{
+		manager:  ipsetManager,
+		existing: existingSets,
+		desired:  desiredSets,
+		plan:     system.PrepareIPSetExecutionPlan(existingSets, desiredSets),
+	}, nil
+}
+
+// prepareIPSetCleanup plans destroying of the managed sets left by runs in the ipset mode. It returns nil
+// when there is nothing to clean up or the ipset binary is not installed, so the sets could not be created.
+func prepareIPSetCleanup(rulePlacement system.RulePlacement) (*ipsetRun, error) {
+	ipsets, err := prepareIPSets([]system.IPSet{}, rulePlacement)
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ipsets.plan.Empty() {
+		return nil, nil
+	}
+	ipsets.cleanup = true
+
+	return ipsets, nil
+}
+
+// apply reconciles managed ipsets and the iptables rules matching them.
+func (run *ipsetRun) apply() error {
+	return run.manager.ExecuteSets(run.plan, run.desired)
+}
+
+// revert rolls back the applied sets when the rules applied after them failed, so the host is restored
+// as a whole. The cause is returned when no sets were applied.
+func (run *ipsetRun) revert(cause error) error {
+	if run == nil {
+		return cause
+	}
+
+	return run.manager.RevertSets(cause)
+}
+
+func printIPSetPlan(plan system.IPSetExecutionPlan) {
+	log.Println("Destroyed sets:")
+	for _, set := range plan.Destroy {
+		log.Printf("  - Set: %s, port: %d\n", set.Name, set.Port)
+	}
+
+	log.Println("New sets:")
+	for _, set := range plan.Create {
+		log.Printf("  - Set: %s, port: %d, members: %d\n", set.Name, set.Port, len(set.Members))
+	}
+
+	log.Println("Updated sets:")
+	for _, change := range plan.Update {
+		log.Printf("  - Set: %s, port: %d, added: %v, deleted: %v\n", change.Set.Name, change.Set.Port, change.Add, change.Delete)
+	}
+}
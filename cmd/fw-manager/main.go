@@ -1,122 +1,455 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/discovery"
+	"github.com/daniel1302/fw-manager/state"
 	"github.com/daniel1302/fw-manager/system"
 	"github.com/daniel1302/fw-manager/types"
+	consulapi "github.com/hashicorp/consul/api"
 )
 
 type fmArgs struct {
 	dryRun bool
+	ipset  bool
 
+	configFilePath        string
 	consulCatalogFilePath string
+	consulClient          consul.ClientConfig
+	consulServices        string
+	consulFilter          string
+	consulHealth          string
+	consulHealthGrace     time.Duration
+	consulConcurrency     int
+	consulTimeout         time.Duration
+	consulRetries         int
+	catalogMaxAge         time.Duration
+	strictCatalog         bool
+	addressPolicy         string
 	networkCIDR           string
 	ipPOverride           string
+	iface                 string
+	rulePlacement         string
+
+	iptablesSaveInput  string
+	iptablesSaveOutput string
+
+	stateDir      string
+	keepSnapshots int
+	lockTimeout   time.Duration
+
+	watch         bool
+	watchDebounce time.Duration
+	register      bool
+	registerTTL   time.Duration
 }
 
 var args fmArgs
 
 func init() {
 	flag.BoolVar(&args.dryRun, "dry-run", false, "Decide if rules should be only printed to the output and not applied")
+	flag.BoolVar(&args.ipset, "ipset", false, "Manage peers with ipsets, one hash:ip set and one iptables rule per port, instead of one iptables rule per peer")
+	flag.StringVar(&args.configFilePath, "config", "", "YAML config file with the consul connection settings, flags override the file")
+	flag.StringVar(&args.consulClient.Address, "consul-address", "", "Address of the consul agent, e.g: https://127.0.0.1:8501. If empty CONSUL_HTTP_ADDR or http://127.0.0.1:8500 is used")
+	flag.StringVar(&args.consulClient.CAFile, "consul-ca-file", "", "CA certificate used to verify the consul agent certificate")
+	flag.StringVar(&args.consulClient.CertFile, "consul-cert-file", "", "Client certificate for the consul agent, requires --consul-key-file")
+	flag.StringVar(&args.consulClient.KeyFile, "consul-key-file", "", "Client key for the consul agent")
+	flag.StringVar(&args.consulClient.TokenFile, "consul-token-file", "", "File with the consul ACL token")
+	flag.StringVar(&args.consulClient.Namespace, "consul-namespace", "", "Consul namespace the services are registered in")
+	flag.StringVar(&args.consulClient.Partition, "consul-partition", "", "Consul admin partition the services are registered in")
 	flag.StringVar(&args.consulCatalogFilePath, "consul-catalog-file-path", "", "If not empty binary won't fetch catalog from consul API. Instead it will use given file")
+	flag.StringVar(&args.consulServices, "consul-services", consul.PrimaryServiceName, "Comma separated names of the consul services the fleet is discovered from, instances of all of them are merged")
+	flag.StringVar(&args.consulFilter, "consul-filter", "", "Consul filter expression applied by the server to every catalog request, e.g: NodeMeta.stage == \"prod\"")
+	flag.StringVar(&args.consulHealth, "consul-health", "", "If not empty the fleet is built from the consul health endpoint with instances which health is: passing or not-critical. Instances in the maintenance mode are always excluded")
+	flag.DurationVar(&args.consulHealthGrace, "consul-health-grace", time.Minute, "How long an unhealthy instance is kept in the fleet, so a brief check flap does not remove the peer access")
+	flag.IntVar(&args.consulConcurrency, "consul-concurrency", consul.DefaultFetchConcurrency, "Maximum number of data-centers fetched from consul at the same time")
+	flag.DurationVar(&args.consulTimeout, "consul-timeout", consul.DefaultFetchTimeout, "Timeout of a single attempt to fetch the data-center catalog")
+	flag.IntVar(&args.consulRetries, "consul-retries", consul.DefaultFetchRetries, "Number of retries after the failed attempt to fetch the data-center catalog")
+	flag.DurationVar(&args.catalogMaxAge, "catalog-max-age", 24*time.Hour, "How old the last-known catalog of the unreachable data-center can be to be used instead, 0 disables the catalog cache")
+	flag.BoolVar(&args.strictCatalog, "strict-catalog", false, "Refuse to apply rules when the consul catalog is inconsistent, e.g: an instance without address or the address used by multiple nodes")
+	flag.StringVar(&args.addressPolicy, "address-policy", string(consul.AddressService), "Comma separated order the consul instance address is resolved in, the first non-empty address is used: service, node, tagged:<name>, e.g: service,tagged:lan_ipv4,node")
 	flag.StringVar(&args.networkCIDR, "network-cidr", "10.10.0.0/16", "The network CIDR for the wireguard")
 	flag.StringVar(&args.ipPOverride, "ip-override", "", "If not empty program will assume local computer has assigned specific IP without checking it")
+	flag.StringVar(&args.iface, "interface", "", "Interface managed rules are bound to with -i. If empty, the interface holding an address from the --network-cidr is used. Use \"none\" to accept traffic from any interface")
+	flag.StringVar(&args.rulePlacement, "rule-placement", "append", "Where managed rules are placed in the INPUT chain: append, top, before:<regexp matching iptables -S rule>, after:<anchor rule comment>")
+	flag.StringVar(&args.iptablesSaveInput, "iptables-save-input", "", "If not empty binary works offline, existing rules are read from given iptables-save file instead of the host iptables")
+	flag.StringVar(&args.iptablesSaveOutput, "iptables-save-output", "", "File where the ruleset after applying rules is written in the iptables-save format, requires --iptables-save-input")
+	flag.StringVar(&args.stateDir, "state-dir", state.DefaultStateDir, "Directory where the pre-change snapshots are stored")
+	flag.IntVar(&args.keepSnapshots, "keep-snapshots", 10, "Number of the last pre-change snapshots kept in the state directory, 0 disables snapshots")
+	flag.DurationVar(&args.lockTimeout, "lock-timeout", 30*time.Second, "How long to wait for another fw-manager run to release the lock in the state directory")
+	flag.BoolVar(&args.watch, "watch", false, "Keep running and apply rules every time the fleet catalog in consul changes")
+	flag.DurationVar(&args.watchDebounce, "watch-debounce", consul.DefaultWatchDebounce, "How long the catalog must stay unchanged before rules are applied in the watch mode")
+	flag.BoolVar(&args.register, "register", false, "Register the fw-manager service with the TTL check reporting the rules sync on the local consul agent, requires --watch")
+	flag.DurationVar(&args.registerTTL, "register-ttl", time.Minute, "TTL of the fw-manager service check, the check is refreshed every half of it")
 	flag.Parse()
 }
 
 func main() {
-	normalizedFleetCatalog, err := normalizedCatalog(args.consulCatalogFilePath)
-	if err != nil {
-		log.Fatal("failed to get normalized fleet catalog", err)
+	switch flag.Arg(0) {
+	case "":
+	case "rollback":
+		if err := runRollback(flag.Args()[1:]); err != nil {
+			log.Fatal("rollback failed: ", err)
+		}
+		return
+	case "catalog":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if err := runCatalog(ctx, flag.Args()[1:]); err != nil {
+			log.Fatal("catalog failed: ", err)
+		}
+		return
+	default:
+		log.Fatalf("unknown command %q, available commands: rollback, catalog", flag.Arg(0))
 	}
 
-	thisComputerFleet, err := matchFleetServerToThisHost(args.ipPOverride, args.networkCIDR, normalizedFleetCatalog)
+	rulePlacement, err := system.ParseRulePlacement(args.rulePlacement)
 	if err != nil {
-		log.Fatal("this computer does not belong to the managed network", err)
+		log.Fatal("invalid rule placement: ", err)
+	}
+
+	if err := validateOfflineArgs(args); err != nil {
+		log.Fatal("invalid offline mode arguments: ", err)
 	}
 
-	catalogRules := system.PrepareFirewallRules(*thisComputerFleet, &normalizedFleetCatalog)
+	if args.register && !args.watch {
+		log.Fatal("--register requires --watch")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	iptables, err := system.NewFirewallManager(nil)
+	if args.watch {
+		if err := runWatch(ctx, rulePlacement); err != nil {
+			log.Fatal("watch failed: ", err)
+		}
+		return
+	}
+
+	if _, err := reconcile(ctx, rulePlacement); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// reconcile fetches the fleet catalog and applies rules for this host, stats of the applied plan are returned
+func reconcile(ctx context.Context, rulePlacement system.RulePlacement) (system.PlanStats, error) {
+	// Offline mode does not touch the host, so it does not wait for runs which do. The lock is taken
+	// before the catalog is read, so the state written by the run is never mixed with another run.
+	if args.iptablesSaveInput == "" {
+		lock, err := state.AcquireLock(args.stateDir, args.lockTimeout)
+		if err != nil {
+			return system.PlanStats{}, fmt.Errorf("failed to acquire lock: %w", err)
+		}
+		defer lock.Release()
+	}
+
+	normalizedFleetCatalog, cachedDatacenters, err := normalizedCatalog(ctx)
 	if err != nil {
-		panic(err)
+		return system.PlanStats{}, fmt.Errorf("failed to get normalized fleet catalog: %w", err)
 	}
 
-	existingRules, err := iptables.ListManagedFirewallRules()
+	thisComputerFleet, err := matchFleetServerToThisHost(args.ipPOverride, args.networkCIDR, normalizedFleetCatalog)
 	if err != nil {
-		panic(err)
+		return system.PlanStats{}, fmt.Errorf("this computer does not belong to the managed network: %w", err)
+	}
+
+	ruleInterface, err := managedRulesInterface(args.iface, args.networkCIDR, args.ipPOverride)
+	if err != nil {
+		return system.PlanStats{}, fmt.Errorf("failed to find interface for managed rules: %w", err)
+	}
+
+	catalogRules := system.BindRulesToInterface(
+		system.PrepareFirewallRules(*thisComputerFleet, &normalizedFleetCatalog),
+		ruleInterface,
+	)
+
+	var ipsets *ipsetRun
+	if args.ipset {
+		ipsets, err = prepareIPSets(system.GroupRulesBySets(catalogRules), rulePlacement)
+		if err != nil {
+			return system.PlanStats{}, fmt.Errorf("failed to prepare ipsets: %w", err)
+		}
+		printIPSetPlan(ipsets.plan)
+
+		// Per peer rules are replaced by the set rules
+		catalogRules = []system.FirewallRule{}
+	} else if args.iptablesSaveInput == "" {
+		// Sets left by runs in the ipset mode are replaced by the per peer rules
+		ipsets, err = prepareIPSetCleanup(rulePlacement)
+		if err != nil {
+			return system.PlanStats{}, fmt.Errorf("failed to prepare ipsets cleanup: %w", err)
+		}
+		if ipsets != nil {
+			printIPSetPlan(ipsets.plan)
+		}
 	}
 
-	oldRules, newRules, err := system.PrepareRulesExecutionPlan(existingRules, catalogRules)
+	var (
+		iptables       *system.FirewallManager
+		offlineRuleset *system.IptablesSave
+	)
+	if args.iptablesSaveInput != "" {
+		offlineRuleset, err = readIptablesSave(args.iptablesSaveInput)
+		if err != nil {
+			return system.PlanStats{}, fmt.Errorf("failed to read iptables-save input: %w", err)
+		}
+		iptables = system.NewOfflineFirewallManager(offlineRuleset)
+	} else {
+		iptables, err = system.NewFirewallManager(nil)
+		if err != nil {
+			return system.PlanStats{}, fmt.Errorf("failed to create firewall manager: %w", err)
+		}
+	}
+	iptables.SetPlacement(rulePlacement)
+
+	existingRules, err := iptables.ListManagedFirewallRules()
 	if err != nil {
-		panic(err)
+		return system.PlanStats{}, fmt.Errorf("failed to list managed rules: %w", err)
 	}
 
-	printRules(newRules, oldRules)
+	// Drifted rules of the plan include rules bound to other interface than the desired rules
+	plan := system.PrepareRulesExecutionPlan(existingRules, catalogRules)
+	for _, event := range system.DriftEvents(plan.Drifted) {
+		log.Printf("Drift detected: %s", event)
+	}
+	printPlan(plan)
 
 	if args.dryRun {
 		log.Println("Dry run, execution skipped")
-		return
+		return plan.Stats, nil
 	}
 
-	if err := iptables.ExecuteRules(newRules, oldRules); err != nil {
-		panic(err)
+	if offlineRuleset == nil {
+		store := state.NewSnapshotStore(args.stateDir, args.keepSnapshots)
+		if err := saveSnapshot(store, iptables, ipsets, plan); err != nil {
+			return system.PlanStats{}, fmt.Errorf("failed to save pre-change snapshot: %w", err)
+		}
 	}
+
+	if ipsets != nil && !ipsets.cleanup {
+		if err := ipsets.apply(); err != nil {
+			return system.PlanStats{}, fmt.Errorf("failed to apply ipsets: %w", err)
+		}
+	}
+
+	if err := iptables.ExecuteRules(plan); err != nil {
+		return system.PlanStats{}, fmt.Errorf("failed to apply rules: %w", ipsets.revert(err))
+	}
+
+	// Sets are destroyed once the per peer rules are in place, so the peers never lose access
+	if ipsets != nil && ipsets.cleanup {
+		if err := ipsets.apply(); err != nil {
+			return system.PlanStats{}, fmt.Errorf("failed to clean up ipsets: %w", err)
+		}
+	}
+
+	if offlineRuleset != nil {
+		if err := writeIptablesSave(args.iptablesSaveOutput, offlineRuleset); err != nil {
+			return system.PlanStats{}, fmt.Errorf("failed to write iptables-save output: %w", err)
+		}
+		log.Printf("Ruleset written to %s", args.iptablesSaveOutput)
+
+		return plan.Stats, nil
+	}
+
+	err = state.SaveRunStatus(args.stateDir, state.RunStatus{
+		RunAt:             time.Now(),
+		CatalogCached:     len(cachedDatacenters) > 0,
+		CachedDatacenters: cachedDatacenters,
+	})
+	if err != nil {
+		return system.PlanStats{}, fmt.Errorf("failed to save run status: %w", err)
+	}
+
+	return plan.Stats, nil
 }
 
-func printRules(new []system.FirewallRule, old []system.FirewallRule) {
+func printPlan(plan system.Plan) {
 	log.Println("Deleted rules:")
-	for _, rule := range old {
+	for _, rule := range plan.Delete {
 		log.Printf("  - Port: %d, source: %s\n", rule.Port, rule.IP)
 	}
 
 	log.Println("New rules:")
-	for _, rule := range new {
+	for _, rule := range plan.Add {
 		log.Printf("  - Port: %d, source: %s\n", rule.Port, rule.IP)
 	}
+
+	log.Printf("Plan: %s", plan.Stats)
 }
 
-func normalizedCatalog(consulCatalogFilePath string) (types.FleetCatalog, error) {
-	var normalizedCatalog types.FleetCatalog
-	if consulCatalogFilePath != "" {
-		consulCatalog, err := consul.ReadLocalCatalog(consulCatalogFilePath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read consul catalog from local file: %w", err)
+// normalizedCatalog returns the fleet catalog of all sources and datacenters which catalog came from the cache
+func normalizedCatalog(ctx context.Context) (types.FleetCatalog, []string, error) {
+	sources, err := catalogSources()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	normalizedCatalog, err := discovery.NewCombinedSource(sources...).Catalog(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cachedDatacenters := []string{}
+	for _, source := range sources {
+		if filtered, ok := source.(*discovery.FilteredSource); ok {
+			source = filtered.Unwrap()
+		}
+		if source, ok := source.(*consulSource); ok {
+			cachedDatacenters = append(cachedDatacenters, source.cachedDatacenters...)
 		}
+	}
 
-		normalizedCatalog, err = consul.NormalizeCatalog(consulCatalog)
-		if err != nil {
-			return nil, fmt.Errorf("failed to normalize local consul catalog: %w", err)
+	return normalizedCatalog, cachedDatacenters, nil
+}
+
+// fetchFleetCatalog fetches the catalog from consul. When consul can not be reached at all,
+// the cached catalog of all datacenters is used instead.
+func fetchFleetCatalog(ctx context.Context, consulApi *consul.ConsulAPIClient) (*consul.FleetCatalog, error) {
+	// TLS and ACL failures are configuration errors, they never fall back to the cache
+	err := consulApi.CheckConnection()
+	var consulDataCenters []string
+	if err == nil {
+		consulDataCenters, err = consulApi.GetDataCenters()
+	}
+	if err != nil {
+		if args.catalogMaxAge <= 0 || errors.Is(err, consul.ErrConnectionRejected) {
+			return nil, fmt.Errorf("failed to get data-centers from consul catalog: %w", err)
+		}
+
+		log.Printf("WARNING: consul can not be reached, using the cached catalog: %s", err)
+		fleetCatalog, cacheErr := consulApi.GetCachedFleetCatalog()
+		if cacheErr != nil {
+			return nil, fmt.Errorf("failed to get data-centers from consul catalog: %w, cached catalog can not be used: %w", err, cacheErr)
 		}
 
-		return normalizedCatalog, nil
+		return fleetCatalog, nil
 	}
 
-	consulApi, err := consul.NewConsulAPIClient(nil)
+	fleetCatalog, err := consulApi.GetFleetCatalog(ctx, consulDataCenters)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create consul api client: %w", err)
+		return nil, fmt.Errorf("failed to get fleet catalog from the consul api: %w", err)
 	}
 
-	consulDataCenters, err := consulApi.GetDataCenters()
+	return fleetCatalog, nil
+}
+
+// newConsulAPIClient creates the consul api client discovering the fleet from the --consul-services
+func newConsulAPIClient(healthThreshold consul.HealthThreshold) (*consul.ConsulAPIClient, error) {
+	clientConfig, err := consulClientConfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get data-centers from consul catalog: %w", err)
+		return nil, err
 	}
 
-	consulCatalog, err := consulApi.GetFleetCatalog(consulDataCenters)
+	client, err := consul.NewClient(clientConfig)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get fleet catalog from the consul api: %w", err)
+		return nil, err
 	}
-	normalizedCatalog, err = consul.NormalizeCatalog(consulCatalog)
+
+	consulApi, err := consul.NewConsulAPIClient(client)
 	if err != nil {
-		return nil, fmt.Errorf("failed to normalize catalog ")
+		return nil, fmt.Errorf("failed to create consul api client: %w", err)
 	}
 
-	return normalizedCatalog, nil
+	services := []string{}
+	for _, service := range strings.Split(args.consulServices, ",") {
+		if service = strings.TrimSpace(service); service != "" {
+			services = append(services, service)
+		}
+	}
+	consulApi.SetServices(services)
+	consulApi.SetWithHealth(healthThreshold != consul.HealthIgnored)
+	consulApi.SetFilter(args.consulFilter)
+
+	fetchConfig := consul.DefaultFetchConfig()
+	fetchConfig.Concurrency = args.consulConcurrency
+	fetchConfig.Timeout = args.consulTimeout
+	fetchConfig.Retries = args.consulRetries
+	consulApi.SetFetchConfig(fetchConfig)
+
+	if args.catalogMaxAge > 0 {
+		consulApi.SetCatalogCache(state.NewCatalogStore(args.stateDir), args.catalogMaxAge)
+	}
+
+	return consulApi, nil
+}
+
+// healthyInstances removes instances not meeting the health threshold. Instances seen healthy and times they
+// were seen unhealthy are kept in the state directory for the grace period.
+func healthyInstances(
+	instances []*consulapi.CatalogService,
+	healthThreshold consul.HealthThreshold,
+) ([]*consulapi.CatalogService, error) {
+	if healthThreshold == consul.HealthIgnored {
+		return instances, nil
+	}
+	if args.consulHealthGrace <= 0 {
+		return consul.FilterHealthy(instances, healthThreshold, nil, time.Now()), nil
+	}
+
+	store := state.NewHealthStore(args.stateDir)
+	health, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	grace := &consul.HealthGrace{
+		Period:         args.consulHealthGrace,
+		Healthy:        health.Healthy,
+		UnhealthySince: health.UnhealthySince,
+	}
+	result := consul.FilterHealthy(instances, healthThreshold, grace, time.Now())
+
+	// Dry and offline runs don't change the host, so they don't move the grace period forward either
+	if args.dryRun || args.iptablesSaveInput != "" {
+		return result, nil
+	}
+
+	if err := store.Save(state.HealthState{Healthy: grace.Healthy, UnhealthySince: grace.UnhealthySince}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// managedRulesInterface returns the interface managed rules are bound to, empty string means any interface
+func managedRulesInterface(iface string, networkCIDR string, ipOverride string) (string, error) {
+	switch {
+	case iface == "none":
+		log.Println("Managed rules accept traffic from any interface")
+		return "", nil
+	case iface == "" && ipOverride != "":
+		// The overridden address is usually not assigned to this host, so the interface can't be detected
+		log.Println("WARNING: --ip-override is set without --interface, managed rules accept traffic from any interface")
+		return "", nil
+	case iface == "":
+		_, wireguardCIDR, err := net.ParseCIDR(networkCIDR)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse the network CIDR: %w", err)
+		}
+
+		iface, err = system.FindInterfaceByCIDR(wireguardCIDR)
+		if err != nil {
+			return "", fmt.Errorf("%w, use --interface to set it explicitly", err)
+		}
+	}
+
+	log.Printf("Managed rules are bound to the %s interface", iface)
+
+	return iface, nil
 }
 
 func matchFleetServerToThisHost(ipOverride string, networkCIDR string, normalizedFleet types.FleetCatalog) (*types.FleetItem, error) {
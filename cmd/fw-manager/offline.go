@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/daniel1302/fw-manager/state"
+	"github.com/daniel1302/fw-manager/system"
+)
+
+// validateOfflineArgs checks if the offline mode has everything it needs to work without access to the host
+func validateOfflineArgs(args fmArgs) error {
+	if args.iptablesSaveInput == "" {
+		if args.iptablesSaveOutput != "" {
+			return fmt.Errorf("--iptables-save-output requires --iptables-save-input")
+		}
+		return nil
+	}
+
+	if args.consulCatalogFilePath == "" {
+		return fmt.Errorf("--iptables-save-input requires --consul-catalog-file-path")
+	}
+	if args.iptablesSaveOutput == "" && !args.dryRun {
+		return fmt.Errorf("--iptables-save-input requires --iptables-save-output or --dry-run")
+	}
+	if args.ipset {
+		return fmt.Errorf("--ipset is not supported in the offline mode")
+	}
+	// interfaces of the computer running the offline mode say nothing about the managed host
+	if args.iface == "" {
+		return fmt.Errorf("--iptables-save-input requires --interface with the interface name or \"none\"")
+	}
+
+	return nil
+}
+
+func readIptablesSave(filePath string) (*system.IptablesSave, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	return system.ReadIptablesSave(file)
+}
+
+// writeIptablesSave writes the ruleset to the file, the file is never left half written
+func writeIptablesSave(filePath string, ruleset *system.IptablesSave) error {
+	return state.WriteFileAtomic(filePath, func(w io.Writer) error {
+		if _, err := ruleset.WriteTo(w); err != nil {
+			return fmt.Errorf("failed to write ruleset: %w", err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/system"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// selfCheck reports the result of the last run to the TTL check of the fw-manager service registered
+// on the local agent
+type selfCheck struct {
+	api *consul.ConsulAPIClient
+	ttl time.Duration
+
+	mu     sync.Mutex
+	status string
+	output string
+	// registered is false until the service is registered and after the failed update, e.g: the agent
+	// restarted and forgot the service, the next update registers it again
+	registered bool
+}
+
+// registerSelf registers the fw-manager service with the status of the initial run. Failed registration
+// is only logged and retried with the heartbeat, so the agent outage never stops applying rules.
+func registerSelf(api *consul.ConsulAPIClient, ttl time.Duration, stats system.PlanStats, runErr error) *selfCheck {
+	check := &selfCheck{api: api, ttl: ttl}
+	check.status, check.output = selfCheckStatus(stats, runErr, time.Now())
+	check.update()
+
+	return check
+}
+
+// selfCheckStatus returns critical when the run failed, warning when the drift was found and fixed
+// or rules are not applied in the dry run
+func selfCheckStatus(stats system.PlanStats, runErr error, now time.Time) (string, string) {
+	at := now.Format(time.RFC3339)
+	switch {
+	case runErr != nil:
+		return consulapi.HealthCritical, fmt.Sprintf("Last apply failed at %s: %s", at, runErr)
+	case args.dryRun:
+		return consulapi.HealthWarning, fmt.Sprintf("Dry run at %s, rules are not applied, plan: %s", at, stats)
+	case stats.Drifted > 0 || stats.Duplicates > 0:
+		return consulapi.HealthWarning, fmt.Sprintf("Drift found and fixed at %s: %d drifted, %d duplicated rules", at, stats.Drifted, stats.Duplicates)
+	default:
+		return consulapi.HealthPassing, fmt.Sprintf("Rules in sync at %s, plan: %s", at, stats)
+	}
+}
+
+// report updates the check with the result of the run
+func (check *selfCheck) report(stats system.PlanStats, runErr error) {
+	check.mu.Lock()
+	check.status, check.output = selfCheckStatus(stats, runErr, time.Now())
+	check.mu.Unlock()
+
+	check.update()
+}
+
+// update sends the last status to the check, the service is registered first when it is not registered yet
+func (check *selfCheck) update() {
+	check.mu.Lock()
+	defer check.mu.Unlock()
+
+	if !check.registered {
+		if err := check.api.RegisterSelf(check.ttl, check.status, check.output); err != nil {
+			log.Printf("Failed to register the %s service, retrying with the next heartbeat: %s", consul.SelfServiceName, err)
+			return
+		}
+		check.registered = true
+		log.Printf("Registered the %s service on the local consul agent, status: %s", consul.SelfServiceName, check.status)
+
+		return
+	}
+
+	// Failed update only makes the check stale, it goes critical after the ttl
+	if err := check.api.UpdateSelfCheck(check.status, check.output); err != nil {
+		log.Printf("Failed to update the %s check, registering it again with the next heartbeat: %s", consul.SelfServiceName, err)
+		check.registered = false
+	}
+}
+
+// heartbeat repeats the last status before the ttl passes, runs happen only when the catalog changes
+func (check *selfCheck) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(check.ttl / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check.update()
+		}
+	}
+}
+
+func (check *selfCheck) deregister() {
+	check.mu.Lock()
+	defer check.mu.Unlock()
+
+	if !check.registered {
+		return
+	}
+
+	if err := check.api.DeregisterSelf(); err != nil {
+		log.Printf("Failed to deregister the %s service: %s", consul.SelfServiceName, err)
+		return
+	}
+	log.Printf("Deregistered the %s service from the local consul agent", consul.SelfServiceName)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/daniel1302/fw-manager/state"
+	"github.com/daniel1302/fw-manager/system"
+)
+
+// runRollback restores managed rules to the state saved before one of the previous runs.
+//
+// Usage: fw-manager [global flags] rollback [--to <run-id>] [--list] [--dry-run]
+func runRollback(cmdArgs []string) error {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	to := flags.String("to", "", "Identifier of the run to restore the state from before it, the latest run when empty")
+	list := flags.Bool("list", false, "Print stored runs and exit")
+	dryRun := flags.Bool("dry-run", args.dryRun, "Print rules which would be restored without applying them")
+	if err := flags.Parse(cmdArgs); err != nil {
+		return err
+	}
+
+	store := state.NewSnapshotStore(args.stateDir, args.keepSnapshots)
+
+	if *list {
+		return printSnapshots(store)
+	}
+
+	lock, err := state.AcquireLock(args.stateDir, args.lockTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer lock.Release()
+
+	snapshot, err := store.Load(*to)
+	if err != nil {
+		return fmt.Errorf("failed to load snapshot: %w", err)
+	}
+	log.Printf("Restoring managed rules from before the %s run", snapshot.RunID)
+
+	rulePlacement, err := system.ParseRulePlacement(args.rulePlacement)
+	if err != nil {
+		return fmt.Errorf("invalid rule placement: %w", err)
+	}
+
+	iptables, err := system.NewFirewallManager(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create firewall manager: %w", err)
+	}
+	iptables.SetPlacement(rulePlacement)
+
+	currentRules, err := iptables.ListManagedFirewallRules()
+	if err != nil {
+		return fmt.Errorf("failed to list managed rules: %w", err)
+	}
+
+	targetRules, err := system.ParseManagedRules(snapshot.Rules)
+	if err != nil {
+		return fmt.Errorf("failed to parse rules from the snapshot: %w", err)
+	}
+
+	plan := system.PrepareRestorePlan(currentRules, targetRules)
+
+	var ipsets *ipsetRun
+	if snapshot.IPSetMode {
+		ipsets, err = prepareIPSets(snapshot.Sets, rulePlacement)
+		if err != nil {
+			return fmt.Errorf("failed to prepare ipsets: %w", err)
+		}
+		printIPSetPlan(ipsets.plan)
+	} else {
+		// Sets left by runs in the ipset mode are destroyed once the per peer rules are restored
+		ipsets, err = prepareIPSetCleanup(rulePlacement)
+		if err != nil {
+			return fmt.Errorf("failed to prepare ipsets cleanup: %w", err)
+		}
+		if ipsets != nil {
+			printIPSetPlan(ipsets.plan)
+		}
+	}
+	printPlan(plan)
+
+	if *dryRun {
+		log.Println("Dry run, execution skipped")
+		return nil
+	}
+
+	// Rollback is a change as any other, so it can be rolled back as well
+	if err := saveSnapshot(store, iptables, ipsets, plan); err != nil {
+		return fmt.Errorf("failed to save pre-change snapshot: %w", err)
+	}
+
+	if ipsets != nil && !ipsets.cleanup {
+		if err := ipsets.apply(); err != nil {
+			return fmt.Errorf("failed to restore ipsets: %w", err)
+		}
+	}
+
+	if err := iptables.ExecuteRules(plan); err != nil {
+		return fmt.Errorf("failed to restore rules: %w", ipsets.revert(err))
+	}
+
+	if ipsets != nil && ipsets.cleanup {
+		if err := ipsets.apply(); err != nil {
+			return fmt.Errorf("failed to clean up ipsets: %w", err)
+		}
+	}
+
+	log.Printf("Managed rules restored to the state from before the %s run", snapshot.RunID)
+
+	return nil
+}
+
+// saveSnapshot saves the ruleset before the change together with the computed change. Nothing is saved when
+// there is nothing to change, so runs without changes do not push out useful snapshots.
+func saveSnapshot(
+	store *state.SnapshotStore,
+	iptables *system.FirewallManager,
+	ipsets *ipsetRun,
+	plan system.Plan,
+) error {
+	if args.keepSnapshots < 1 {
+		return nil
+	}
+	if plan.Empty() && (ipsets == nil || ipsets.plan.Empty()) {
+		return nil
+	}
+
+	ruleset, err := iptables.SaveRuleset()
+	if err != nil {
+		return err
+	}
+
+	rules, err := iptables.ListRules()
+	if err != nil {
+		return err
+	}
+
+	snapshot := state.Snapshot{
+		RunID:     state.NewRunID(time.Now()),
+		CreatedAt: time.Now(),
+		Ruleset:   ruleset,
+		Rules:     rules,
+		Plan:      state.SnapshotPlan{Plan: plan},
+	}
+	if ipsets != nil {
+		snapshot.IPSetMode = true
+		snapshot.Sets = ipsets.existing
+		snapshot.Plan.IPSets = &ipsets.plan
+	}
+
+	if err := store.Save(snapshot); err != nil {
+		return err
+	}
+	log.Printf("Pre-change snapshot saved, run id: %s", snapshot.RunID)
+
+	return nil
+}
+
+func printSnapshots(store *state.SnapshotStore) error {
+	runs, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Stored runs:")
+	for _, runID := range runs {
+		snapshot, err := store.Load(runID)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("  - Run: %s, created at: %s, added rules: %d, deleted rules: %d\n",
+			snapshot.RunID,
+			snapshot.CreatedAt.Format(time.RFC3339),
+			len(snapshot.Plan.Add),
+			len(snapshot.Plan.Delete),
+		)
+	}
+
+	return nil
+}
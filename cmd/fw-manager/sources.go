@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/discovery"
+	"github.com/daniel1302/fw-manager/types"
+)
+
+const (
+	sourceConsul     = "consul"
+	sourceConsulFile = "consul-file"
+	sourceInventory  = "inventory"
+	sourceDNS        = "dns"
+)
+
+// consulSource discovers the fleet from the consul api configured with flags
+type consulSource struct {
+	normalizer *consul.Normalizer
+	// cachedDatacenters are datacenters which catalog came from the cache in the last call
+	cachedDatacenters []string
+}
+
+func (source *consulSource) Name() string {
+	return sourceConsul
+}
+
+func (source *consulSource) Catalog(ctx context.Context) (types.FleetCatalog, error) {
+	healthThreshold, err := consul.ParseHealthThreshold(args.consulHealth)
+	if err != nil {
+		return nil, err
+	}
+
+	consulApi, err := newConsulAPIClient(healthThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	fleetCatalog, err := fetchFleetCatalog(ctx, consulApi)
+	if err != nil {
+		return nil, err
+	}
+	if len(fleetCatalog.CachedDatacenters) > 0 {
+		log.Printf("WARNING: the run is based on the cached catalog of: %v", fleetCatalog.CachedDatacenters)
+	}
+	source.cachedDatacenters = fleetCatalog.CachedDatacenters
+
+	consulCatalog, err := healthyInstances(fleetCatalog.Services, healthThreshold)
+	if err != nil {
+		return nil, err
+	}
+	normalizedCatalog, err := source.normalizer.Normalize(consulCatalog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize catalog: %w", err)
+	}
+
+	return normalizedCatalog, nil
+}
+
+// catalogSources returns sources from the config file in the priority order, consul when none is configured.
+// The --consul-catalog-file-path replaces the consul api with the local file.
+func catalogSources() ([]discovery.CatalogSource, error) {
+	config, err := readConfigFile(args.configFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceConfigs := config.Sources
+	if len(sourceConfigs) == 0 {
+		sourceConfigs = []sourceConfig{{Type: sourceConsul}}
+	}
+
+	normalizer, err := consulNormalizer()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]discovery.CatalogSource, 0, len(sourceConfigs))
+	for idx, sourceConfig := range sourceConfigs {
+		if sourceConfig.Type == sourceConsul && args.consulCatalogFilePath != "" {
+			sourceConfig.Type = sourceConsulFile
+			sourceConfig.Path = args.consulCatalogFilePath
+		}
+
+		source, err := newCatalogSource(sourceConfig, normalizer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid catalog source %d: %w", idx, err)
+		}
+
+		if sourceConfig.Filter != nil {
+			filter, err := discovery.NewItemFilter(*sourceConfig.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter of the catalog source %d: %w", idx, err)
+			}
+			source = discovery.NewFilteredSource(source, filter)
+		}
+		result = append(result, source)
+	}
+
+	return result, nil
+}
+
+func newCatalogSource(config sourceConfig, normalizer *consul.Normalizer) (discovery.CatalogSource, error) {
+	switch config.Type {
+	case sourceConsul:
+		return &consulSource{normalizer: normalizer}, nil
+	case sourceConsulFile, sourceInventory:
+		if config.Path == "" {
+			return nil, fmt.Errorf("the %s source requires the path", config.Type)
+		}
+		if config.Type == sourceConsulFile {
+			return discovery.NewConsulFileSource(config.Path, normalizer), nil
+		}
+		return discovery.NewInventorySource(config.Path), nil
+	case sourceDNS:
+		if len(config.Records) == 0 {
+			return nil, fmt.Errorf("the dns source requires records")
+		}
+		return discovery.NewDNSSource(config.Resolver, config.Records), nil
+	default:
+		return nil, fmt.Errorf("unknown source type %q, expected one of: consul, consul-file, inventory, dns", config.Type)
+	}
+}
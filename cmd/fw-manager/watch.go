@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/discovery"
+	"github.com/daniel1302/fw-manager/system"
+)
+
+// runWatch applies rules once and then every time the fleet catalog changes, until the process is stopped.
+// Datacenters are fetched once at the start, new datacenters require restart.
+func runWatch(ctx context.Context, rulePlacement system.RulePlacement) error {
+	if args.consulCatalogFilePath != "" || args.iptablesSaveInput != "" {
+		return fmt.Errorf("--watch requires the consul api, it can not be used with --consul-catalog-file-path or --iptables-save-input")
+	}
+
+	if args.register && args.registerTTL <= 0 {
+		return fmt.Errorf("--register-ttl must be positive")
+	}
+
+	sources, err := catalogSources()
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(sources, func(source discovery.CatalogSource) bool { return source.Name() == sourceConsul }) {
+		return fmt.Errorf("--watch requires the consul catalog source")
+	}
+
+	healthThreshold, err := consul.ParseHealthThreshold(args.consulHealth)
+	if err != nil {
+		return err
+	}
+
+	consulApi, err := newConsulAPIClient(healthThreshold)
+	if err != nil {
+		return err
+	}
+
+	if err := consulApi.CheckConnection(); err != nil {
+		return err
+	}
+
+	consulDataCenters, err := consulApi.GetDataCenters()
+	if err != nil {
+		return fmt.Errorf("failed to get data-centers from consul catalog: %w", err)
+	}
+
+	// Failed run is logged only, the next change or the restored ruleset is picked up by the next run
+	stats, err := reconcile(ctx, rulePlacement)
+	if err != nil {
+		log.Printf("Failed to apply rules: %s", err)
+	}
+
+	var check *selfCheck
+	if args.register {
+		check = registerSelf(consulApi, args.registerTTL, stats, err)
+		defer check.deregister()
+		go check.heartbeat(ctx)
+	}
+
+	config := consul.DefaultWatchConfig()
+	config.Debounce = args.watchDebounce
+	// Health checks may stay failing without any catalog change, instances leaving the grace period are
+	// removed by the periodic run
+	if healthThreshold != consul.HealthIgnored && args.consulHealthGrace > 0 {
+		config.Resync = args.consulHealthGrace
+	}
+
+	log.Printf("Watching the fleet catalog in %v data-centers", consulDataCenters)
+	err = consulApi.WatchFleetCatalog(ctx, consulDataCenters, config, func() {
+		log.Println("Fleet catalog changed, applying rules")
+		stats, err := reconcile(ctx, rulePlacement)
+		if err != nil {
+			log.Printf("Failed to apply rules: %s", err)
+		}
+		if check != nil {
+			check.report(stats, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("Watch stopped")
+
+	return nil
+}
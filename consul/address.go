@@ -0,0 +1,77 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// AddressSource is where the instance address is taken from: service, node or tagged:<name>
+type AddressSource string
+
+const (
+	AddressService AddressSource = "service"
+	AddressNode    AddressSource = "node"
+
+	taggedAddressPrefix = "tagged:"
+)
+
+// TaggedAddress is the named tagged address, e.g: lan_ipv4 or wan. The service tagged address is used
+// before the node tagged address.
+func TaggedAddress(name string) AddressSource {
+	return AddressSource(taggedAddressPrefix + name)
+}
+
+// AddressPolicy is the order the instance address is resolved in, the first non-empty address is used
+type AddressPolicy []AddressSource
+
+// DefaultAddressPolicy uses only the service address
+func DefaultAddressPolicy() AddressPolicy {
+	return AddressPolicy{AddressService}
+}
+
+// ParseAddressPolicy parses comma separated address sources, e.g: `service,tagged:lan_ipv4,node`
+func ParseAddressPolicy(value string) (AddressPolicy, error) {
+	result := AddressPolicy{}
+	for _, item := range strings.Split(value, ",") {
+		source := AddressSource(strings.TrimSpace(item))
+		switch {
+		case source == AddressService, source == AddressNode:
+		case strings.HasPrefix(string(source), taggedAddressPrefix) && len(source) > len(taggedAddressPrefix):
+		default:
+			return nil, fmt.Errorf("invalid address source %q, expected one of: service, node, tagged:<name>", source)
+		}
+
+		result = append(result, source)
+	}
+
+	return result, nil
+}
+
+// Resolve returns the first non-empty address of the instance and its source, empty when there is none
+func (policy AddressPolicy) Resolve(service *consulapi.CatalogService) (string, AddressSource) {
+	for _, source := range policy {
+		if address := source.address(service); address != "" {
+			return address, source
+		}
+	}
+
+	return "", ""
+}
+
+func (source AddressSource) address(service *consulapi.CatalogService) string {
+	switch source {
+	case AddressService:
+		return service.ServiceAddress
+	case AddressNode:
+		return service.Address
+	}
+
+	name := strings.TrimPrefix(string(source), taggedAddressPrefix)
+	if address, ok := service.ServiceTaggedAddresses[name]; ok && address.Address != "" {
+		return address.Address
+	}
+
+	return service.TaggedAddresses[name]
+}
@@ -0,0 +1,92 @@
+package consul_test
+
+import (
+	"testing"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/types"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressPolicy(t *testing.T) {
+	policy, err := consul.ParseAddressPolicy("service, tagged:lan_ipv4, node")
+	require.NoError(t, err)
+	assert.Equal(t, consul.AddressPolicy{consul.AddressService, consul.TaggedAddress("lan_ipv4"), consul.AddressNode}, policy)
+
+	t.Run("Invalid policy", func(t *testing.T) {
+		for _, value := range []string{"", "service,", "tagged:", "wan"} {
+			_, err := consul.ParseAddressPolicy(value)
+			assert.Error(t, err, value)
+		}
+	})
+
+	t.Run("First non-empty address is used", func(t *testing.T) {
+		testCases := []struct {
+			name           string
+			service        *consulapi.CatalogService
+			expected       string
+			expectedSource consul.AddressSource
+		}{
+			{
+				name:           "service address",
+				service:        &consulapi.CatalogService{ServiceAddress: "10.10.0.17", Address: "192.168.1.17"},
+				expected:       "10.10.0.17",
+				expectedSource: consul.AddressService,
+			},
+			{
+				name: "service tagged address",
+				service: &consulapi.CatalogService{
+					ServiceTaggedAddresses: map[string]consulapi.ServiceAddress{"lan_ipv4": {Address: "10.10.0.18", Port: 51820}},
+					TaggedAddresses:        map[string]string{"lan_ipv4": "192.168.1.18"},
+				},
+				expected:       "10.10.0.18",
+				expectedSource: consul.TaggedAddress("lan_ipv4"),
+			},
+			{
+				name:           "node tagged address",
+				service:        &consulapi.CatalogService{TaggedAddresses: map[string]string{"lan_ipv4": "10.10.0.19"}, Address: "192.168.1.19"},
+				expected:       "10.10.0.19",
+				expectedSource: consul.TaggedAddress("lan_ipv4"),
+			},
+			{
+				name:           "node address",
+				service:        &consulapi.CatalogService{Address: "10.10.0.20"},
+				expected:       "10.10.0.20",
+				expectedSource: consul.AddressNode,
+			},
+			{
+				name:    "no address",
+				service: &consulapi.CatalogService{},
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				address, source := policy.Resolve(tc.service)
+				assert.Equal(t, tc.expected, address)
+				assert.Equal(t, tc.expectedSource, source)
+			})
+		}
+	})
+
+	t.Run("Fleet items record the address source", func(t *testing.T) {
+		normalizer := consul.NewNormalizer()
+		normalizer.SetAddressPolicy(policy)
+
+		fleet, err := normalizer.Normalize([]*consulapi.CatalogService{
+			{ID: "n1", Node: "node-01", ServiceName: "wireguard", ServiceTags: []string{"metrics.prod"}, Address: "10.10.0.17"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, types.FleetCatalog{
+			types.FleetMetrics: {{Type: types.FleetMetrics, ID: "n1", Node: "node-01", Address: "10.10.0.17", Service: "wireguard", AddressSource: "node"}},
+		}, fleet)
+
+		// the default policy uses only the service address
+		fleet, err = consul.NormalizeCatalog([]*consulapi.CatalogService{
+			{ID: "n1", Node: "node-01", ServiceName: "wireguard", ServiceTags: []string{"metrics.prod"}, Address: "10.10.0.17"},
+		})
+		require.NoError(t, err)
+		assert.Empty(t, fleet)
+	})
+}
@@ -2,24 +2,36 @@ package consul
 
 import (
 	"fmt"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 )
 
 const (
+	// PrimaryServiceName is the service discovered when no other services are configured
 	PrimaryServiceName = "wireguard"
 )
 
 var ErrMissingConsulClient error = fmt.Errorf("consul api client is nil")
 
 type ConsulAPIClient struct {
-	client *consulapi.Client
+	client   *consulapi.Client
+	services []string
+	// withHealth makes the client fetch instances from the health endpoint, together with their checks
+	withHealth bool
+	// filter is the consul filter expression applied by the server to every catalog request
+	filter      string
+	fetch       FetchConfig
+	cache       CatalogCache
+	cacheMaxAge time.Duration
 }
 
 func NewConsulAPIClient(client *consulapi.Client) (*ConsulAPIClient, error) {
 	if client != nil {
 		return &ConsulAPIClient{
-			client: client,
+			client:   client,
+			services: []string{PrimaryServiceName},
+			fetch:    DefaultFetchConfig(),
 		}, nil
 	}
 
@@ -30,10 +42,33 @@ func NewConsulAPIClient(client *consulapi.Client) (*ConsulAPIClient, error) {
 	}
 
 	return &ConsulAPIClient{
-		client: consul,
+		client:   consul,
+		services: []string{PrimaryServiceName},
+		fetch:    DefaultFetchConfig(),
 	}, nil
 }
 
+// SetServices sets names of the services the fleet is discovered from, empty list means the primary service
+func (api *ConsulAPIClient) SetServices(services []string) {
+	if len(services) == 0 {
+		services = []string{PrimaryServiceName}
+	}
+
+	api.services = services
+}
+
+// SetWithHealth switches the client to the health endpoint, fetched instances carry their health checks
+func (api *ConsulAPIClient) SetWithHealth(withHealth bool) {
+	api.withHealth = withHealth
+}
+
+// SetFilter sets the consul filter expression, e.g: `NodeMeta.stage == "prod"`, so instances are filtered
+// by the server instead of downloading the whole catalog. The health endpoint uses different selectors,
+// e.g: `Node.Meta.stage == "prod"`.
+func (api *ConsulAPIClient) SetFilter(filter string) {
+	api.filter = filter
+}
+
 // GetDataCenters fetches all data centers available in the consul cluster
 func (api *ConsulAPIClient) GetDataCenters() ([]string, error) {
 	if api.client == nil {
@@ -43,23 +78,50 @@ func (api *ConsulAPIClient) GetDataCenters() ([]string, error) {
 	return api.client.Catalog().Datacenters()
 }
 
-func (api *ConsulAPIClient) GetFleetCatalog(datacenters []string) ([]*consulapi.CatalogService, error) {
-	if api.client == nil {
-		return nil, ErrMissingConsulClient
+// serviceInstances fetches instances of the service from the catalog or the health endpoint
+func (api *ConsulAPIClient) serviceInstances(
+	service string,
+	opts *consulapi.QueryOptions,
+) ([]*consulapi.CatalogService, *consulapi.QueryMeta, error) {
+	opts.Filter = api.filter
+	if !api.withHealth {
+		return api.client.Catalog().Service(service, "", opts)
+	}
+
+	entries, meta, err := api.client.Health().Service(service, "", false, opts)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	allServices := []*consulapi.CatalogService{}
+	result := make([]*consulapi.CatalogService, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, serviceEntryToCatalogService(entry))
+	}
 
-	for _, dc := range datacenters {
-		resp, _, err := api.client.Catalog().Service(PrimaryServiceName, "", &consulapi.QueryOptions{
-			Datacenter: dc,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("failed to get catalog for the \"%s\" service in %s DC: %w", PrimaryServiceName, dc, err)
-		}
+	return result, meta, nil
+}
 
-		allServices = append(allServices, resp...)
+func serviceEntryToCatalogService(entry *consulapi.ServiceEntry) *consulapi.CatalogService {
+	result := &consulapi.CatalogService{Checks: entry.Checks}
+	if entry.Node != nil {
+		result.ID = entry.Node.ID
+		result.Node = entry.Node.Node
+		result.Address = entry.Node.Address
+		result.Datacenter = entry.Node.Datacenter
+		result.TaggedAddresses = entry.Node.TaggedAddresses
+		result.NodeMeta = entry.Node.Meta
+	}
+	if entry.Service != nil {
+		result.ServiceID = entry.Service.ID
+		result.ServiceName = entry.Service.Service
+		result.ServiceAddress = entry.Service.Address
+		result.ServiceTaggedAddresses = entry.Service.TaggedAddresses
+		result.ServiceTags = entry.Service.Tags
+		result.ServiceMeta = entry.Service.Meta
+		result.ServicePort = entry.Service.Port
+		result.Namespace = entry.Service.Namespace
+		result.Partition = entry.Service.Partition
 	}
 
-	return allServices, nil
+	return result
 }
@@ -0,0 +1,74 @@
+package consul_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/types"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetFleetCatalogMultipleServices(t *testing.T) {
+	catalog := map[string][]*consulapi.CatalogService{
+		"wireguard-staging": {
+			{ID: "w1", Node: "node-01", ServiceName: "wireguard-staging", ServiceAddress: "10.10.0.17", ServiceTags: []string{"metrics.staging"}},
+		},
+		"node-exporter": {
+			{ID: "n1", Node: "node-02", ServiceName: "node-exporter", ServiceAddress: "10.10.0.18", ServiceTags: []string{"app.staging"}},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		services, ok := catalog[strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")]
+		if !ok {
+			services = []*consulapi.CatalogService{}
+		}
+		json.NewEncoder(w).Encode(services)
+	}))
+	defer server.Close()
+
+	client, err := consulapi.NewClient(&consulapi.Config{Address: server.URL})
+	require.NoError(t, err)
+	api, err := consul.NewConsulAPIClient(client)
+	require.NoError(t, err)
+	api.SetServices([]string{"wireguard-staging", "node-exporter"})
+
+	fleetCatalog, err := api.GetFleetCatalog(context.Background(), []string{"dc1"})
+	require.NoError(t, err)
+
+	fleet, err := consul.NormalizeCatalog(fleetCatalog.Services)
+	require.NoError(t, err)
+	assert.Equal(t, types.FleetCatalog{
+		types.FleetMetrics: {{Type: types.FleetMetrics, ID: "w1", Node: "node-01", Address: "10.10.0.17", Service: "wireguard-staging", AddressSource: "service"}},
+		types.FleetApp:     {{Type: types.FleetApp, ID: "n1", Node: "node-02", Address: "10.10.0.18", Service: "node-exporter", AddressSource: "service"}},
+	}, fleet)
+}
+
+func TestGetFleetCatalogFilter(t *testing.T) {
+	filters := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters <- r.URL.Query().Get("filter")
+		json.NewEncoder(w).Encode([]*consulapi.CatalogService{})
+	}))
+	defer server.Close()
+
+	client, err := consulapi.NewClient(&consulapi.Config{Address: server.URL})
+	require.NoError(t, err)
+	api, err := consul.NewConsulAPIClient(client)
+	require.NoError(t, err)
+	api.SetServices([]string{"wireguard", "node-exporter"})
+	api.SetFilter(`NodeMeta.stage == "prod"`)
+
+	_, err = api.GetFleetCatalog(context.Background(), []string{"dc1"})
+	require.NoError(t, err)
+
+	// the filter is sent with the request of every service
+	assert.Equal(t, `NodeMeta.stage == "prod"`, <-filters)
+	assert.Equal(t, `NodeMeta.stage == "prod"`, <-filters)
+}
@@ -0,0 +1,164 @@
+package consul
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+var ErrNoCachedCatalog error = fmt.Errorf("no cached catalog")
+
+// CatalogCache keeps the last catalog fetched from every datacenter
+type CatalogCache interface {
+	// Load returns the last catalog fetched from the datacenter or the ErrNoCachedCatalog
+	Load(datacenter string) (*DatacenterCatalog, error)
+	Save(catalog DatacenterCatalog) error
+	// Datacenters returns the datacenters consul reported in the last successful fetch, empty when unknown
+	Datacenters() ([]string, error)
+	// SaveDatacenters stores the datacenters and removes the cached catalog of datacenters not on the list
+	SaveDatacenters(datacenters []string) error
+}
+
+// DatacenterCatalog is the catalog fetched from one datacenter
+type DatacenterCatalog struct {
+	Datacenter string
+	FetchedAt  time.Time
+	// Index is the highest consul index of the fetched services
+	Index uint64
+	// Settings is the hash of the settings the catalog was fetched with, see ConsulAPIClient.settingsHash
+	Settings string
+	Services []*consulapi.CatalogService
+}
+
+// SetCatalogCache makes the client keep the last-known catalog of every datacenter and use it, up to
+// the maxAge, when the datacenter can not be reached
+func (api *ConsulAPIClient) SetCatalogCache(cache CatalogCache, maxAge time.Duration) {
+	api.cache = cache
+	api.cacheMaxAge = maxAge
+}
+
+// GetCachedFleetCatalog returns the last-known catalog of the datacenters from the last successful fetch. It is
+// used when consul can not be reached at all, every datacenter must be cached and not older than the max age.
+func (api *ConsulAPIClient) GetCachedFleetCatalog() (*FleetCatalog, error) {
+	if api.cache == nil {
+		return nil, ErrNoCachedCatalog
+	}
+
+	datacenters, err := api.cache.Datacenters()
+	if err != nil {
+		return nil, err
+	}
+	if len(datacenters) == 0 {
+		return nil, ErrNoCachedCatalog
+	}
+
+	result := &FleetCatalog{
+		Services:          []*consulapi.CatalogService{},
+		Datacenters:       []DatacenterMetadata{},
+		CachedDatacenters: []string{},
+	}
+	for _, dc := range datacenters {
+		catalog, err := api.loadFromCache(dc, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		result.addCached(catalog)
+	}
+
+	return result, nil
+}
+
+// addCached adds the last-known catalog of the unreachable datacenter
+func (catalog *FleetCatalog) addCached(cached *DatacenterCatalog) {
+	catalog.Services = append(catalog.Services, cached.Services...)
+	catalog.Datacenters = append(catalog.Datacenters, DatacenterMetadata{
+		Name:      cached.Datacenter,
+		FetchedAt: cached.FetchedAt,
+		Index:     cached.Index,
+		Cached:    true,
+	})
+	catalog.CachedDatacenters = append(catalog.CachedDatacenters, cached.Datacenter)
+}
+
+// settingsHash identifies the settings deciding which instances are fetched, the catalog cached
+// with other services, filter or health settings is never used
+func (api *ConsulAPIClient) settingsHash() string {
+	services := slices.Clone(api.services)
+	slices.Sort(services)
+
+	data, _ := json.Marshal(struct {
+		Services   []string
+		WithHealth bool
+		Filter     string
+	}{
+		Services:   services,
+		WithHealth: api.withHealth,
+		Filter:     api.filter,
+	})
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// saveToCache stores the fetched catalog. Failure only costs the fallback, so it does not fail the run.
+func (api *ConsulAPIClient) saveToCache(result datacenterResult, fetchedAt time.Time) {
+	if api.cache == nil {
+		return
+	}
+
+	err := api.cache.Save(DatacenterCatalog{
+		Datacenter: result.datacenter,
+		FetchedAt:  fetchedAt,
+		Index:      result.index,
+		Settings:   api.settingsHash(),
+		Services:   result.services,
+	})
+	if err != nil {
+		log.Printf("Failed to cache the catalog of %s DC: %s", result.datacenter, err)
+	}
+}
+
+// saveDatacentersToCache stores the datacenters consul reported, so the datacenters removed from consul
+// are not required when consul can not be reached. Failure only costs the fallback, so it does not fail the run.
+func (api *ConsulAPIClient) saveDatacentersToCache(datacenters []string) {
+	if api.cache == nil {
+		return
+	}
+
+	if err := api.cache.SaveDatacenters(datacenters); err != nil {
+		log.Printf("Failed to cache the list of datacenters: %s", err)
+	}
+}
+
+// loadFromCache returns the last-known instances of the datacenter when they are not older than the max age
+func (api *ConsulAPIClient) loadFromCache(datacenter string, now time.Time) (*DatacenterCatalog, error) {
+	if api.cache == nil {
+		return nil, ErrNoCachedCatalog
+	}
+
+	catalog, err := api.cache.Load(datacenter)
+	if err != nil {
+		return nil, err
+	}
+	if catalog.Settings != api.settingsHash() {
+		return nil, fmt.Errorf("%w: catalog of %s DC was cached with other services, filter or health settings", ErrNoCachedCatalog, datacenter)
+	}
+
+	age := now.Sub(catalog.FetchedAt)
+	if age > api.cacheMaxAge {
+		return nil, fmt.Errorf("cached catalog of %s DC is %s old, max age is %s", datacenter, age.Round(time.Second), api.cacheMaxAge)
+	}
+
+	log.Printf("WARNING: %s DC is unreachable, using its last-known catalog from %s (%s old)",
+		datacenter,
+		catalog.FetchedAt.Format(time.RFC3339),
+		age.Round(time.Second),
+	)
+
+	return catalog, nil
+}
@@ -0,0 +1,173 @@
+package consul
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/daniel1302/fw-manager/types"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// nodeNameTypeGroup is the regexp group of the node name strategy holding the fleet type
+const nodeNameTypeGroup = "type"
+
+// ClassificationStrategy finds the fleet type of the service instance
+type ClassificationStrategy interface {
+	// Name identifies the strategy in the conflict report, e.g: `node-meta:env`
+	Name() string
+	// Classify returns types.FleetUnknown when the strategy can not classify the instance
+	Classify(service *consulapi.CatalogService) types.FleetType
+}
+
+// TagsStrategy classifies instances by the `<fleet_type>.*` service tag, see types.FleetTagsToFleetType
+type TagsStrategy struct{}
+
+func (TagsStrategy) Name() string {
+	return "tags"
+}
+
+func (TagsStrategy) Classify(service *consulapi.CatalogService) types.FleetType {
+	return types.FleetTagsToFleetType(service.ServiceTags)
+}
+
+// NodeMetaStrategy classifies instances by the node meta value, e.g: `env = "metrics"`
+type NodeMetaStrategy struct {
+	Key string
+}
+
+func (strategy NodeMetaStrategy) Name() string {
+	return "node-meta:" + strategy.Key
+}
+
+func (strategy NodeMetaStrategy) Classify(service *consulapi.CatalogService) types.FleetType {
+	fleetType, err := types.ParseFleetType(service.NodeMeta[strategy.Key])
+	if err != nil {
+		return types.FleetUnknown
+	}
+
+	return fleetType
+}
+
+// NodeNameStrategy classifies instances by the node name matching the regexp with the `type` named group,
+// e.g: `^node-\d+\.[^.]+\.(?P<type>[^.]+)\.[^.]+$` for `node-01.eu-dc1.metrics.prod`
+type NodeNameStrategy struct {
+	pattern *regexp.Regexp
+	group   int
+}
+
+func NewNodeNameStrategy(pattern string) (*NodeNameStrategy, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile node name pattern: %w", err)
+	}
+
+	group := re.SubexpIndex(nodeNameTypeGroup)
+	if group < 0 {
+		return nil, fmt.Errorf("node name pattern %q has no (?P<%s>...) group", pattern, nodeNameTypeGroup)
+	}
+
+	return &NodeNameStrategy{
+		pattern: re,
+		group:   group,
+	}, nil
+}
+
+func (strategy *NodeNameStrategy) Name() string {
+	return "node-name"
+}
+
+func (strategy *NodeNameStrategy) Classify(service *consulapi.CatalogService) types.FleetType {
+	match := strategy.pattern.FindStringSubmatch(service.Node)
+	if match == nil {
+		return types.FleetUnknown
+	}
+
+	fleetType, err := types.ParseFleetType(match[strategy.group])
+	if err != nil {
+		return types.FleetUnknown
+	}
+
+	return fleetType
+}
+
+// Classifier finds the fleet type with strategies in the priority order, the first strategy classifying
+// the instance wins
+type Classifier struct {
+	strategies []ClassificationStrategy
+}
+
+func NewClassifier(strategies ...ClassificationStrategy) *Classifier {
+	return &Classifier{
+		strategies: strategies,
+	}
+}
+
+// DefaultClassifier classifies instances by service tags only
+func DefaultClassifier() *Classifier {
+	return NewClassifier(TagsStrategy{})
+}
+
+func (classifier *Classifier) Classify(service *consulapi.CatalogService) types.FleetType {
+	for _, strategy := range classifier.strategies {
+		if fleetType := strategy.Classify(service); fleetType != types.FleetUnknown {
+			return fleetType
+		}
+	}
+
+	return types.FleetUnknown
+}
+
+// ClassificationConflict is the instance which strategies disagree about its fleet type
+type ClassificationConflict struct {
+	Datacenter string
+	Node       string
+	ServiceID  string
+	// Types are fleet types found by strategies, strategies which did not classify the instance are skipped
+	Types map[string]types.FleetType
+	// Chosen is the type from the strategy with the highest priority
+	Chosen types.FleetType
+}
+
+func (conflict ClassificationConflict) String() string {
+	strategies := make([]string, 0, len(conflict.Types))
+	for strategy := range conflict.Types {
+		strategies = append(strategies, strategy)
+	}
+	slices.Sort(strategies)
+
+	found := make([]string, 0, len(strategies))
+	for _, strategy := range strategies {
+		found = append(found, fmt.Sprintf("%s=%s", strategy, conflict.Types[strategy]))
+	}
+
+	return fmt.Sprintf("%s/%s/%s: %s, using %s", conflict.Datacenter, conflict.Node, conflict.ServiceID, strings.Join(found, ", "), conflict.Chosen)
+}
+
+// Conflicts returns instances classified differently by at least two strategies
+func (classifier *Classifier) Conflicts(services []*consulapi.CatalogService) []ClassificationConflict {
+	result := []ClassificationConflict{}
+	for _, service := range services {
+		found := map[string]types.FleetType{}
+		distinct := map[types.FleetType]bool{}
+		for _, strategy := range classifier.strategies {
+			if fleetType := strategy.Classify(service); fleetType != types.FleetUnknown {
+				found[strategy.Name()] = fleetType
+				distinct[fleetType] = true
+			}
+		}
+
+		if len(distinct) > 1 {
+			result = append(result, ClassificationConflict{
+				Datacenter: service.Datacenter,
+				Node:       service.Node,
+				ServiceID:  service.ServiceID,
+				Types:      found,
+				Chosen:     classifier.Classify(service),
+			})
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,80 @@
+package consul_test
+
+import (
+	"testing"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/types"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifier(t *testing.T) {
+	nodeName, err := consul.NewNodeNameStrategy(`^node-\d+\.[^.]+\.(?P<type>[^.]+)\.[^.]+$`)
+	require.NoError(t, err)
+
+	classifier := consul.NewClassifier(consul.TagsStrategy{}, consul.NodeMetaStrategy{Key: "env"}, nodeName)
+
+	consistent := &consulapi.CatalogService{
+		Datacenter:  "eu-dc1",
+		Node:        "node-01.eu-dc1.metrics.prod",
+		ServiceID:   "wireguard",
+		ServiceTags: []string{"metrics.prod"},
+		NodeMeta:    map[string]string{"env": "metrics"},
+	}
+	untagged := &consulapi.CatalogService{
+		Datacenter: "eu-dc1",
+		Node:       "node-02.eu-dc1.logs.prod",
+		ServiceID:  "wireguard",
+		NodeMeta:   map[string]string{"env": "logs"},
+	}
+	nameOnly := &consulapi.CatalogService{
+		Datacenter: "eu-dc1",
+		Node:       "node-03.eu-dc1.backups.prod",
+		ServiceID:  "wireguard",
+	}
+	conflicting := &consulapi.CatalogService{
+		Datacenter:  "us-dc",
+		Node:        "node-04.us-dc.logs.prod",
+		ServiceID:   "wireguard",
+		ServiceTags: []string{"app.prod"},
+		NodeMeta:    map[string]string{"env": "metrics"},
+	}
+	unknown := &consulapi.CatalogService{Node: "bastion", NodeMeta: map[string]string{"env": "infra"}}
+
+	t.Run("Strategies in the priority order", func(t *testing.T) {
+		assert.Equal(t, types.FleetMetrics, classifier.Classify(consistent))
+		assert.Equal(t, types.FleetLogs, classifier.Classify(untagged))
+		assert.Equal(t, types.FleetBackups, classifier.Classify(nameOnly))
+		assert.Equal(t, types.FleetApp, classifier.Classify(conflicting))
+		assert.Equal(t, types.FleetUnknown, classifier.Classify(unknown))
+
+		assert.Equal(t, types.FleetUnknown, consul.DefaultClassifier().Classify(untagged))
+	})
+
+	t.Run("Conflict report", func(t *testing.T) {
+		conflicts := classifier.Conflicts([]*consulapi.CatalogService{consistent, untagged, nameOnly, conflicting, unknown})
+		require.Len(t, conflicts, 1)
+		assert.Equal(t, consul.ClassificationConflict{
+			Datacenter: "us-dc",
+			Node:       "node-04.us-dc.logs.prod",
+			ServiceID:  "wireguard",
+			Types: map[string]types.FleetType{
+				"tags":          types.FleetApp,
+				"node-meta:env": types.FleetMetrics,
+				"node-name":     types.FleetLogs,
+			},
+			Chosen: types.FleetApp,
+		}, conflicts[0])
+		assert.Equal(t, "us-dc/node-04.us-dc.logs.prod/wireguard: node-meta:env=metrics, node-name=logs, tags=app, using app", conflicts[0].String())
+	})
+
+	t.Run("Node name pattern requires the type group", func(t *testing.T) {
+		_, err := consul.NewNodeNameStrategy(`^node-\d+\.[^.]+\.([^.]+)\.[^.]+$`)
+		assert.ErrorContains(t, err, "(?P<type>...)")
+
+		_, err = consul.NewNodeNameStrategy(`(`)
+		assert.Error(t, err)
+	})
+}
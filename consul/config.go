@@ -0,0 +1,169 @@
+package consul
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+var ErrConnectionRejected error = fmt.Errorf("consul agent rejected the connection")
+
+// ClientConfig is the connection to the consul agent. Empty fields keep the consul defaults,
+// including the CONSUL_HTTP_* environment variables.
+type ClientConfig struct {
+	// Address of the agent, e.g: https://127.0.0.1:8501
+	Address   string `yaml:"address"`
+	CAFile    string `yaml:"ca_file"`
+	CertFile  string `yaml:"cert_file"`
+	KeyFile   string `yaml:"key_file"`
+	TokenFile string `yaml:"token_file"`
+	Namespace string `yaml:"namespace"`
+	Partition string `yaml:"partition"`
+}
+
+// Merge returns the config with the non-empty fields of the override
+func (config ClientConfig) Merge(override ClientConfig) ClientConfig {
+	merge := func(value *string, override string) {
+		if override != "" {
+			*value = override
+		}
+	}
+
+	merge(&config.Address, override.Address)
+	merge(&config.CAFile, override.CAFile)
+	merge(&config.CertFile, override.CertFile)
+	merge(&config.KeyFile, override.KeyFile)
+	merge(&config.TokenFile, override.TokenFile)
+	merge(&config.Namespace, override.Namespace)
+	merge(&config.Partition, override.Partition)
+
+	return config
+}
+
+// Validate checks the config before any connection is made
+func (config ClientConfig) Validate() error {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("client certificate and key must be set together")
+	}
+
+	files := []struct{ name, path string }{
+		{"CA file", config.CAFile},
+		{"client certificate", config.CertFile},
+		{"client key", config.KeyFile},
+		{"ACL token file", config.TokenFile},
+	}
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			return fmt.Errorf("failed to read consul %s: %w", file.name, err)
+		}
+	}
+
+	if config.TokenFile != "" {
+		token, err := os.ReadFile(config.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read consul ACL token file: %w", err)
+		}
+		if strings.TrimSpace(string(token)) == "" {
+			return fmt.Errorf("consul ACL token file %s is empty", config.TokenFile)
+		}
+	}
+
+	return nil
+}
+
+// NewClient creates the consul client from the config
+func NewClient(config ClientConfig) (*consulapi.Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid consul config: %w", err)
+	}
+
+	apiConfig := consulapi.DefaultConfig()
+	if config.Address != "" {
+		apiConfig.Address = config.Address
+	}
+	if config.CAFile != "" {
+		apiConfig.TLSConfig.CAFile = config.CAFile
+	}
+	if config.CertFile != "" {
+		apiConfig.TLSConfig.CertFile = config.CertFile
+		apiConfig.TLSConfig.KeyFile = config.KeyFile
+	}
+	// TLS files make sense only with the https, the address without the scheme is switched to it
+	if (config.CAFile != "" || config.CertFile != "") && !strings.Contains(apiConfig.Address, "://") {
+		apiConfig.Scheme = "https"
+	}
+	if config.TokenFile != "" {
+		apiConfig.TokenFile = config.TokenFile
+	}
+	if config.Namespace != "" {
+		apiConfig.Namespace = config.Namespace
+	}
+	if config.Partition != "" {
+		apiConfig.Partition = config.Partition
+	}
+
+	client, err := consulapi.NewClient(apiConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consul client: %w", err)
+	}
+
+	return client, nil
+}
+
+// CheckConnection checks the agent can be reached and accepts the ACL token. The error explains
+// the TLS and ACL failures.
+func (api *ConsulAPIClient) CheckConnection() error {
+	if api.client == nil {
+		return ErrMissingConsulClient
+	}
+
+	if _, err := api.client.Status().Leader(); err != nil {
+		return explainConnectionError(err)
+	}
+
+	// Any existing token, including the anonymous one, can read itself
+	_, _, err := api.client.ACL().TokenReadSelf(nil)
+	var statusErr consulapi.StatusError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &statusErr) && statusErr.Code == http.StatusUnauthorized && strings.Contains(statusErr.Body, "ACL support disabled"):
+		// the token is ignored by the cluster without ACLs
+		return nil
+	default:
+		return explainConnectionError(err)
+	}
+}
+
+// explainConnectionError adds the hint what to check to the TLS and ACL errors. They are wrapped
+// with the ErrConnectionRejected, as they are caused by the configuration, not by the agent being down.
+func explainConnectionError(err error) error {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostnameErr      x509.HostnameError
+		invalidCert      x509.CertificateInvalidError
+		statusErr        consulapi.StatusError
+	)
+
+	switch {
+	case errors.As(err, &unknownAuthority), errors.As(err, &invalidCert), errors.As(err, &hostnameErr):
+		return fmt.Errorf("%w: TLS verification of the agent certificate failed, check the consul address and CA file: %w", ErrConnectionRejected, err)
+	case strings.Contains(err.Error(), "tls: certificate required"), strings.Contains(err.Error(), "tls: bad certificate"),
+		strings.Contains(err.Error(), "tls: unknown certificate authority"):
+		return fmt.Errorf("%w: client certificate is not accepted, check the client certificate and key: %w", ErrConnectionRejected, err)
+	case strings.Contains(err.Error(), "server gave HTTP response to HTTPS client"):
+		return fmt.Errorf("%w: agent does not serve https on the given address, check the consul address: %w", ErrConnectionRejected, err)
+	case errors.As(err, &statusErr) && (statusErr.Code == http.StatusForbidden || statusErr.Code == http.StatusUnauthorized):
+		return fmt.Errorf("%w: ACL token is not accepted, check the ACL token file: %w", ErrConnectionRejected, err)
+	}
+
+	return fmt.Errorf("failed to connect to the consul agent: %w", err)
+}
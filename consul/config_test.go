@@ -0,0 +1,91 @@
+package consul_test
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConnection(t *testing.T) {
+	dir := t.TempDir()
+	tokenResponse := http.StatusOK
+	tokenBody := `{"AccessorID": "a1b2", "SecretID": "c3d4"}`
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/status/leader":
+			w.Write([]byte(`"10.10.0.2:8300"`))
+		case "/v1/acl/token/self":
+			w.WriteHeader(tokenResponse)
+			w.Write([]byte(tokenBody))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("c3d4\n"), 0o600))
+
+	checkConnection := func(config consul.ClientConfig) error {
+		client, err := consul.NewClient(config)
+		require.NoError(t, err)
+		api, err := consul.NewConsulAPIClient(client)
+		require.NoError(t, err)
+
+		return api.CheckConnection()
+	}
+
+	t.Run("Valid TLS and token", func(t *testing.T) {
+		assert.NoError(t, checkConnection(consul.ClientConfig{Address: server.URL, CAFile: caFile, TokenFile: tokenFile}))
+	})
+
+	t.Run("Unknown certificate authority", func(t *testing.T) {
+		err := checkConnection(consul.ClientConfig{Address: server.URL})
+		assert.ErrorIs(t, err, consul.ErrConnectionRejected)
+		assert.ErrorContains(t, err, "CA file")
+	})
+
+	t.Run("Rejected token", func(t *testing.T) {
+		tokenResponse, tokenBody = http.StatusForbidden, "ACL not found"
+		err := checkConnection(consul.ClientConfig{Address: server.URL, CAFile: caFile, TokenFile: tokenFile})
+		assert.ErrorIs(t, err, consul.ErrConnectionRejected)
+		assert.ErrorContains(t, err, "ACL token")
+	})
+
+	t.Run("Cluster without ACLs", func(t *testing.T) {
+		tokenResponse, tokenBody = http.StatusUnauthorized, "ACL support disabled"
+		assert.NoError(t, checkConnection(consul.ClientConfig{Address: server.URL, CAFile: caFile}))
+	})
+
+	t.Run("Agent is down", func(t *testing.T) {
+		err := checkConnection(consul.ClientConfig{Address: "127.0.0.1:1"})
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, consul.ErrConnectionRejected)
+	})
+}
+
+func TestClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	emptyToken := filepath.Join(dir, "empty-token")
+	require.NoError(t, os.WriteFile(emptyToken, nil, 0o600))
+
+	assert.ErrorContains(t, consul.ClientConfig{CertFile: "client.pem"}.Validate(), "certificate and key must be set together")
+	assert.ErrorContains(t, consul.ClientConfig{CAFile: filepath.Join(dir, "missing.pem")}.Validate(), "CA file")
+	assert.ErrorContains(t, consul.ClientConfig{TokenFile: emptyToken}.Validate(), "is empty")
+
+	fileConfig := consul.ClientConfig{Address: "https://consul.service:8501", Namespace: "infra"}
+	assert.Equal(t,
+		consul.ClientConfig{Address: "https://consul.service:8501", Namespace: "infra", Partition: "eu"},
+		fileConfig.Merge(consul.ClientConfig{Partition: "eu"}),
+	)
+}
@@ -0,0 +1,45 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// CatalogDump is the fleet catalog together with the metadata of the fetch. It is written by the
+// `catalog dump` command and read back by ReadLocalCatalog, e.g: to replay the production catalog in the dry-run.
+type CatalogDump struct {
+	FetchedAt   time.Time
+	Datacenters []DatacenterMetadata
+	Services    []*consulapi.CatalogService
+}
+
+// NewCatalogDump returns the dump of the fleet catalog fetched at the given time
+func NewCatalogDump(catalog *FleetCatalog, fetchedAt time.Time) CatalogDump {
+	return CatalogDump{
+		FetchedAt:   fetchedAt.UTC(),
+		Datacenters: catalog.Datacenters,
+		Services:    catalog.Services,
+	}
+}
+
+// WriteCatalogDump writes the dump in the format accepted by ReadLocalCatalog
+func WriteCatalogDump(w io.Writer, dump CatalogDump) error {
+	if dump.Datacenters == nil {
+		dump.Datacenters = []DatacenterMetadata{}
+	}
+	if dump.Services == nil {
+		dump.Services = []*consulapi.CatalogService{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(dump); err != nil {
+		return fmt.Errorf("failed to write catalog dump: %w", err)
+	}
+
+	return nil
+}
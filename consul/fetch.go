@@ -0,0 +1,193 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	DefaultFetchConcurrency = 4
+	DefaultFetchTimeout     = 30 * time.Second
+	DefaultFetchRetries     = 2
+)
+
+type FetchConfig struct {
+	// Concurrency is the maximum number of datacenters fetched at the same time
+	Concurrency int
+	// Timeout limits a single attempt to fetch the datacenter
+	Timeout time.Duration
+	// Retries is the number of attempts after the first failed one
+	Retries int
+	// MinBackoff and MaxBackoff limit the delay before the failed attempt is retried
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func DefaultFetchConfig() FetchConfig {
+	return FetchConfig{
+		Concurrency: DefaultFetchConcurrency,
+		Timeout:     DefaultFetchTimeout,
+		Retries:     DefaultFetchRetries,
+		MinBackoff:  DefaultMinBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+	}
+}
+
+func (api *ConsulAPIClient) SetFetchConfig(config FetchConfig) {
+	api.fetch = config
+}
+
+// datacenterResult is the result of fetching instances from one datacenter
+type datacenterResult struct {
+	datacenter string
+	services   []*consulapi.CatalogService
+	// index is the highest consul index of the fetched services
+	index uint64
+	err   error
+}
+
+// FleetCatalog is the catalog fetched from all the datacenters
+type FleetCatalog struct {
+	Services []*consulapi.CatalogService
+	// Datacenters describes where and when the catalog of every datacenter was fetched, in the fetch order
+	Datacenters []DatacenterMetadata
+	// CachedDatacenters are datacenters which could not be reached, their instances come from the last-known catalog
+	CachedDatacenters []string
+}
+
+// DatacenterMetadata describes the catalog fetched from one datacenter
+type DatacenterMetadata struct {
+	Name      string
+	FetchedAt time.Time
+	// Index is the highest consul index of the fetched services, 0 when unknown
+	Index uint64
+	// Cached is true when the datacenter could not be reached and its last-known catalog was used
+	Cached bool `json:",omitempty"`
+}
+
+// GetFleetCatalog fetches instances of all the configured services in given datacenters. Datacenters are
+// fetched concurrently, a slow datacenter fails after the timeout and retries instead of stalling the run.
+// Instances of the unreachable datacenter come from the catalog cache when it is set and not too old.
+func (api *ConsulAPIClient) GetFleetCatalog(ctx context.Context, datacenters []string) (*FleetCatalog, error) {
+	if api.client == nil {
+		return nil, ErrMissingConsulClient
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	result := &FleetCatalog{
+		Services:          []*consulapi.CatalogService{},
+		Datacenters:       []DatacenterMetadata{},
+		CachedDatacenters: []string{},
+	}
+	for _, dcResult := range api.fetchDatacenters(ctx, datacenters) {
+		if dcResult.err == nil {
+			fetchedAt := time.Now()
+			api.saveToCache(dcResult, fetchedAt)
+			result.Services = append(result.Services, dcResult.services...)
+			result.Datacenters = append(result.Datacenters, DatacenterMetadata{
+				Name:      dcResult.datacenter,
+				FetchedAt: fetchedAt,
+				Index:     dcResult.index,
+			})
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return nil, dcResult.err
+		}
+
+		catalog, err := api.loadFromCache(dcResult.datacenter, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("%w, last-known catalog can not be used: %w", dcResult.err, err)
+		}
+		result.addCached(catalog)
+	}
+	api.saveDatacentersToCache(datacenters)
+
+	return result, nil
+}
+
+// fetchDatacenters fetches datacenters with bounded concurrency, results are in the order of datacenters
+func (api *ConsulAPIClient) fetchDatacenters(ctx context.Context, datacenters []string) []datacenterResult {
+	results := make([]datacenterResult, len(datacenters))
+	slots := make(chan struct{}, max(api.fetch.Concurrency, 1))
+
+	wg := sync.WaitGroup{}
+	for idx, dc := range datacenters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				results[idx] = datacenterResult{datacenter: dc, err: fmt.Errorf("failed to fetch %s DC: %w", dc, ctx.Err())}
+				return
+			}
+
+			services, index, err := api.fetchDatacenter(ctx, dc)
+			results[idx] = datacenterResult{datacenter: dc, services: services, index: index, err: err}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// fetchDatacenter fetches instances of all the configured services in the datacenter, retrying failed attempts
+func (api *ConsulAPIClient) fetchDatacenter(ctx context.Context, dc string) ([]*consulapi.CatalogService, uint64, error) {
+	start := time.Now()
+	backoff := api.fetch.MinBackoff
+
+	for attempt := 0; ; attempt++ {
+		services, index, err := api.fetchDatacenterOnce(ctx, dc)
+		if err == nil {
+			log.Printf("Fetched %d instances from %s DC in %s, attempts: %d", len(services), dc, time.Since(start).Round(time.Millisecond), attempt+1)
+			return services, index, nil
+		}
+		if ctx.Err() != nil || attempt >= api.fetch.Retries {
+			log.Printf("Failed to fetch %s DC in %s, attempts: %d", dc, time.Since(start).Round(time.Millisecond), attempt+1)
+			return nil, 0, err
+		}
+
+		log.Printf("Failed to fetch %s DC, retrying in %s: %s", dc, backoff, err)
+		if !sleepContext(ctx, backoff) {
+			return nil, 0, err
+		}
+		backoff = min(backoff*2, api.fetch.MaxBackoff)
+	}
+}
+
+func (api *ConsulAPIClient) fetchDatacenterOnce(ctx context.Context, dc string) ([]*consulapi.CatalogService, uint64, error) {
+	if api.fetch.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, api.fetch.Timeout)
+		defer cancel()
+	}
+
+	result := []*consulapi.CatalogService{}
+	index := uint64(0)
+	for _, service := range api.services {
+		resp, meta, err := api.serviceInstances(service, (&consulapi.QueryOptions{
+			Datacenter: dc,
+		}).WithContext(ctx))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to get catalog for the \"%s\" service in %s DC: %w", service, dc, err)
+		}
+
+		result = append(result, resp...)
+		if meta != nil {
+			index = max(index, meta.LastIndex)
+		}
+	}
+
+	return result, index, nil
+}
@@ -0,0 +1,198 @@
+package consul_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daniel1302/fw-manager/consul"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetFleetCatalogDatacenters(t *testing.T) {
+	mu := sync.Mutex{}
+	attempts := map[string]int{}
+
+	attemptsOf := func(dc string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts[dc]
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dc := r.URL.Query().Get("dc")
+
+		mu.Lock()
+		attempts[dc]++
+		attempt := attempts[dc]
+		mu.Unlock()
+
+		switch {
+		case dc == "us-dc":
+			// slow WAN link, never answers in time
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		case dc == "eu-dc2" && attempt == 1:
+			http.Error(w, "rpc error: no path to datacenter", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("X-Consul-Index", "42")
+		json.NewEncoder(w).Encode([]*consulapi.CatalogService{{Node: "node-01." + dc, Datacenter: dc}})
+	}))
+	defer server.Close()
+
+	client, err := consulapi.NewClient(&consulapi.Config{Address: server.URL})
+	require.NoError(t, err)
+	api, err := consul.NewConsulAPIClient(client)
+	require.NoError(t, err)
+	api.SetFetchConfig(consul.FetchConfig{
+		Concurrency: 2,
+		Timeout:     100 * time.Millisecond,
+		Retries:     1,
+		MinBackoff:  10 * time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+	})
+
+	t.Run("Failed datacenter is retried", func(t *testing.T) {
+		catalog, err := api.GetFleetCatalog(context.Background(), []string{"eu-dc", "eu-dc2", "asia-dc"})
+		require.NoError(t, err)
+
+		// instances are in the order of datacenters
+		assert.Equal(t, []string{"node-01.eu-dc", "node-01.eu-dc2", "node-01.asia-dc"}, catalogNodes(catalog))
+		assert.Empty(t, catalog.CachedDatacenters)
+		assert.Equal(t, 2, attemptsOf("eu-dc2"))
+
+		require.Len(t, catalog.Datacenters, 3)
+		assert.Equal(t, "eu-dc2", catalog.Datacenters[1].Name)
+		assert.Equal(t, uint64(42), catalog.Datacenters[1].Index)
+		assert.False(t, catalog.Datacenters[1].FetchedAt.IsZero())
+	})
+
+	t.Run("Slow datacenter times out", func(t *testing.T) {
+		start := time.Now()
+		_, err := api.GetFleetCatalog(context.Background(), []string{"eu-dc", "us-dc"})
+		assert.ErrorContains(t, err, "us-dc")
+		assert.Less(t, time.Since(start), 2*time.Second)
+		assert.Equal(t, 2, attemptsOf("us-dc"))
+	})
+
+	t.Run("Cancelled context stops fetching", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := api.GetFleetCatalog(ctx, []string{"eu-dc"})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Unreachable datacenter uses last-known catalog", func(t *testing.T) {
+		cache := &memoryCatalogCache{catalogs: map[string]consul.DatacenterCatalog{}}
+		api.SetCatalogCache(cache, time.Hour)
+
+		// nothing cached yet
+		_, err := api.GetFleetCatalog(context.Background(), []string{"eu-dc", "us-dc"})
+		assert.ErrorIs(t, err, consul.ErrNoCachedCatalog)
+		_, err = api.GetCachedFleetCatalog()
+		assert.ErrorIs(t, err, consul.ErrNoCachedCatalog)
+
+		// reachable datacenter was cached with the settings of the client
+		settings := cache.catalogs["eu-dc"].Settings
+		assert.NotEmpty(t, settings)
+
+		cache.catalogs["us-dc"] = consul.DatacenterCatalog{
+			Datacenter: "us-dc",
+			FetchedAt:  time.Now().Add(-10 * time.Minute),
+			Index:      7,
+			Settings:   settings,
+			Services:   []*consulapi.CatalogService{{Node: "node-01.us-dc.cached", Datacenter: "us-dc"}},
+		}
+		// datacenter removed from consul long time ago
+		cache.catalogs["old-dc"] = consul.DatacenterCatalog{
+			Datacenter: "old-dc",
+			FetchedAt:  time.Now().Add(-30 * 24 * time.Hour),
+		}
+
+		catalog, err := api.GetFleetCatalog(context.Background(), []string{"eu-dc", "us-dc"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"node-01.eu-dc", "node-01.us-dc.cached"}, catalogNodes(catalog))
+		assert.Equal(t, []string{"us-dc"}, catalog.CachedDatacenters)
+		assert.Equal(t, consul.DatacenterMetadata{Name: "us-dc", FetchedAt: cache.catalogs["us-dc"].FetchedAt, Index: 7, Cached: true}, catalog.Datacenters[1])
+		// reachable datacenter is cached
+		assert.Equal(t, []*consulapi.CatalogService{{Node: "node-01.eu-dc", Datacenter: "eu-dc"}}, cache.catalogs["eu-dc"].Services)
+		assert.Equal(t, uint64(42), cache.catalogs["eu-dc"].Index)
+		// only datacenters reported by consul are kept
+		assert.Equal(t, []string{"eu-dc", "us-dc"}, cache.datacenters)
+		assert.NotContains(t, cache.catalogs, "old-dc")
+
+		// consul can not be reached at all
+		catalog, err = api.GetCachedFleetCatalog()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"node-01.eu-dc", "node-01.us-dc.cached"}, catalogNodes(catalog))
+		assert.Equal(t, []string{"eu-dc", "us-dc"}, catalog.CachedDatacenters)
+
+		// catalog cached with other settings contains other instances
+		api.SetFilter(`ServiceMeta.env == "prod"`)
+		_, err = api.GetCachedFleetCatalog()
+		assert.ErrorIs(t, err, consul.ErrNoCachedCatalog)
+		api.SetFilter("")
+
+		api.SetCatalogCache(cache, 5*time.Minute)
+		_, err = api.GetFleetCatalog(context.Background(), []string{"eu-dc", "us-dc"})
+		assert.ErrorContains(t, err, "max age is 5m0s")
+		_, err = api.GetCachedFleetCatalog()
+		assert.ErrorContains(t, err, "max age is 5m0s")
+	})
+}
+
+type memoryCatalogCache struct {
+	catalogs    map[string]consul.DatacenterCatalog
+	datacenters []string
+}
+
+func (cache *memoryCatalogCache) Load(datacenter string) (*consul.DatacenterCatalog, error) {
+	catalog, ok := cache.catalogs[datacenter]
+	if !ok {
+		return nil, consul.ErrNoCachedCatalog
+	}
+
+	return &catalog, nil
+}
+
+func (cache *memoryCatalogCache) Save(catalog consul.DatacenterCatalog) error {
+	cache.catalogs[catalog.Datacenter] = catalog
+	return nil
+}
+
+func (cache *memoryCatalogCache) Datacenters() ([]string, error) {
+	return append([]string{}, cache.datacenters...), nil
+}
+
+func (cache *memoryCatalogCache) SaveDatacenters(datacenters []string) error {
+	cache.datacenters = datacenters
+	for dc := range cache.catalogs {
+		if !slices.Contains(datacenters, dc) {
+			delete(cache.catalogs, dc)
+		}
+	}
+
+	return nil
+}
+
+func catalogNodes(catalog *consul.FleetCatalog) []string {
+	nodes := []string{}
+	for _, service := range catalog.Services {
+		nodes = append(nodes, service.Node)
+	}
+
+	return nodes
+}
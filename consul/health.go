@@ -0,0 +1,134 @@
+package consul
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+type HealthThreshold string
+
+const (
+	// HealthIgnored builds the fleet from the catalog, health of instances is not checked
+	HealthIgnored     HealthThreshold = ""
+	HealthPassing     HealthThreshold = "passing"
+	HealthNotCritical HealthThreshold = "not-critical"
+)
+
+func ParseHealthThreshold(threshold string) (HealthThreshold, error) {
+	switch HealthThreshold(threshold) {
+	case HealthIgnored, HealthPassing, HealthNotCritical:
+		return HealthThreshold(threshold), nil
+	}
+
+	return HealthIgnored, fmt.Errorf("unknown health threshold %q, expected %s or %s", threshold, HealthPassing, HealthNotCritical)
+}
+
+// Healthy checks if aggregated status of the instance checks meets the threshold.
+// Instances in the maintenance mode never meet the threshold.
+func (threshold HealthThreshold) Healthy(status string) bool {
+	switch threshold {
+	case HealthIgnored:
+		return true
+	case HealthPassing:
+		return status == consulapi.HealthPassing
+	case HealthNotCritical:
+		return status == consulapi.HealthPassing || status == consulapi.HealthWarning
+	}
+
+	return false
+}
+
+// HealthGrace keeps unhealthy instances in the fleet until they are unhealthy longer than the grace period,
+// so a brief check flap does not cut the peer off. Only instances seen healthy before get the grace period,
+// new unhealthy instances and instances in the maintenance mode are removed immediately.
+type HealthGrace struct {
+	Period time.Duration
+	// Healthy keeps instances seen healthy since they joined the catalog, by the instance key
+	Healthy map[string]bool
+	// UnhealthySince keeps when the instance was seen unhealthy for the first time, by the instance key
+	UnhealthySince map[string]time.Time
+}
+
+// FilterHealthy returns instances meeting the threshold and unhealthy instances, seen healthy before, still in
+// the grace period.
+// Instances must be fetched with the health checks, see SetWithHealth. Grace may be nil.
+func FilterHealthy(
+	services []*consulapi.CatalogService,
+	threshold HealthThreshold,
+	grace *HealthGrace,
+	now time.Time,
+) []*consulapi.CatalogService {
+	if threshold == HealthIgnored {
+		return services
+	}
+
+	if grace != nil && grace.Healthy == nil {
+		grace.Healthy = map[string]bool{}
+	}
+	if grace != nil && grace.UnhealthySince == nil {
+		grace.UnhealthySince = map[string]time.Time{}
+	}
+
+	seen := map[string]bool{}
+	result := []*consulapi.CatalogService{}
+	for _, service := range services {
+		key := instanceKey(service)
+		seen[key] = true
+
+		status := service.Checks.AggregatedStatus()
+		if threshold.Healthy(status) {
+			if grace != nil {
+				grace.Healthy[key] = true
+				delete(grace.UnhealthySince, key)
+			}
+			result = append(result, service)
+			continue
+		}
+
+		if grace == nil || status == consulapi.HealthMaint || !grace.Healthy[key] {
+			// instance back from the maintenance must be seen healthy again to get the grace period
+			if grace != nil {
+				delete(grace.Healthy, key)
+				delete(grace.UnhealthySince, key)
+			}
+			log.Printf("Instance %s excluded from the fleet, health: %s", key, status)
+			continue
+		}
+
+		since, ok := grace.UnhealthySince[key]
+		if !ok {
+			since = now
+			grace.UnhealthySince[key] = now
+		}
+		if now.Sub(since) < grace.Period {
+			log.Printf("Instance %s kept in the fleet in the grace period, health: %s, unhealthy since: %s", key, status, since.Format(time.RFC3339))
+			result = append(result, service)
+			continue
+		}
+
+		log.Printf("Instance %s excluded from the fleet, health: %s, unhealthy since: %s", key, status, since.Format(time.RFC3339))
+	}
+
+	// Forget instances which left the catalog, they start the grace period again when they come back
+	if grace != nil {
+		for key := range grace.Healthy {
+			if !seen[key] {
+				delete(grace.Healthy, key)
+			}
+		}
+		for key := range grace.UnhealthySince {
+			if !seen[key] {
+				delete(grace.UnhealthySince, key)
+			}
+		}
+	}
+
+	return result
+}
+
+func instanceKey(service *consulapi.CatalogService) string {
+	return fmt.Sprintf("%s/%s/%s", service.Datacenter, service.Node, service.ServiceID)
+}
@@ -0,0 +1,97 @@
+package consul_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daniel1302/fw-manager/consul"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func instanceWithChecks(node string, checks ...*consulapi.HealthCheck) *consulapi.CatalogService {
+	return &consulapi.CatalogService{
+		Datacenter:  "dc1",
+		Node:        node,
+		ServiceID:   "wireguard",
+		ServiceName: "wireguard",
+		Checks:      checks,
+	}
+}
+
+func TestFilterHealthy(t *testing.T) {
+	passing := &consulapi.HealthCheck{CheckID: "serfHealth", Status: consulapi.HealthPassing}
+	warning := &consulapi.HealthCheck{CheckID: "service:wireguard", Status: consulapi.HealthWarning}
+	critical := &consulapi.HealthCheck{CheckID: "service:wireguard", Status: consulapi.HealthCritical}
+	maintenance := &consulapi.HealthCheck{CheckID: consulapi.NodeMaint, Status: consulapi.HealthCritical}
+
+	instances := []*consulapi.CatalogService{
+		instanceWithChecks("node-01", passing),
+		instanceWithChecks("node-02", passing, warning),
+		instanceWithChecks("node-03", passing, critical),
+		instanceWithChecks("node-04", passing, maintenance),
+	}
+	nodes := func(services []*consulapi.CatalogService) []string {
+		result := []string{}
+		for _, service := range services {
+			result = append(result, service.Node)
+		}
+		return result
+	}
+	now := time.Date(2024, 9, 16, 10, 0, 0, 0, time.UTC)
+
+	t.Run("Thresholds", func(t *testing.T) {
+		assert.Equal(t, []string{"node-01", "node-02", "node-03", "node-04"}, nodes(consul.FilterHealthy(instances, consul.HealthIgnored, nil, now)))
+		assert.Equal(t, []string{"node-01"}, nodes(consul.FilterHealthy(instances, consul.HealthPassing, nil, now)))
+		assert.Equal(t, []string{"node-01", "node-02"}, nodes(consul.FilterHealthy(instances, consul.HealthNotCritical, nil, now)))
+	})
+
+	t.Run("Grace period", func(t *testing.T) {
+		grace := &consul.HealthGrace{Period: time.Minute}
+
+		// instances are seen healthy before the flap
+		healthy := []*consulapi.CatalogService{
+			instanceWithChecks("node-01", passing),
+			instanceWithChecks("node-02", passing),
+			instanceWithChecks("node-03", passing),
+			instanceWithChecks("node-04", passing),
+		}
+		assert.Len(t, consul.FilterHealthy(healthy, consul.HealthNotCritical, grace, now.Add(-time.Minute)), 4)
+
+		// the flap starts, maintenance is never kept
+		assert.Equal(t, []string{"node-01", "node-02", "node-03"}, nodes(consul.FilterHealthy(instances, consul.HealthNotCritical, grace, now)))
+		assert.Equal(t, map[string]time.Time{"dc1/node-03/wireguard": now}, grace.UnhealthySince)
+
+		assert.Equal(t, []string{"node-01", "node-02", "node-03"}, nodes(consul.FilterHealthy(instances, consul.HealthNotCritical, grace, now.Add(59*time.Second))))
+		assert.Equal(t, []string{"node-01", "node-02"}, nodes(consul.FilterHealthy(instances, consul.HealthNotCritical, grace, now.Add(time.Minute))))
+
+		// recovered instance starts the grace period from the beginning on the next failure
+		recovered := []*consulapi.CatalogService{instanceWithChecks("node-03", passing)}
+		assert.Equal(t, []string{"node-03"}, nodes(consul.FilterHealthy(recovered, consul.HealthNotCritical, grace, now.Add(2*time.Minute))))
+		assert.Empty(t, grace.UnhealthySince)
+	})
+
+	t.Run("Grace period only for instances seen healthy", func(t *testing.T) {
+		grace := &consul.HealthGrace{Period: time.Minute}
+
+		// new instance unhealthy on the first sight is removed immediately
+		assert.Equal(t, []string{"node-01", "node-02"}, nodes(consul.FilterHealthy(instances, consul.HealthNotCritical, grace, now)))
+		assert.Empty(t, grace.UnhealthySince)
+		assert.Equal(t, map[string]bool{"dc1/node-01/wireguard": true, "dc1/node-02/wireguard": true}, grace.Healthy)
+
+		// instance which left the catalog is new again when it comes back
+		assert.Empty(t, consul.FilterHealthy([]*consulapi.CatalogService{}, consul.HealthNotCritical, grace, now))
+		assert.Empty(t, grace.Healthy)
+		flapping := []*consulapi.CatalogService{instanceWithChecks("node-01", critical)}
+		assert.Empty(t, consul.FilterHealthy(flapping, consul.HealthNotCritical, grace, now))
+	})
+
+	t.Run("Parse threshold", func(t *testing.T) {
+		threshold, err := consul.ParseHealthThreshold("not-critical")
+		assert.NoError(t, err)
+		assert.Equal(t, consul.HealthNotCritical, threshold)
+
+		_, err = consul.ParseHealthThreshold("warning")
+		assert.Error(t, err)
+	})
+}
@@ -1,26 +1,191 @@
 package consul
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 
 	consulapi "github.com/hashicorp/consul/api"
 )
 
+// StdinPath makes ReadLocalCatalog read the catalog from the standard input
+const StdinPath = "-"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
 // Function read local catalog and parse it's content, catalog may be
-// delivered by hand or fetched with curl before the fw-manager binary is executed?
+// delivered by hand or fetched with curl before the fw-manager binary is executed.
+// The file may be gzip compressed, `-` reads the catalog from the standard input.
 func ReadLocalCatalog(filePath string) ([]*consulapi.CatalogService, error) {
-	// todo: think about use streams
-	data, err := os.ReadFile(filePath)
+	dump, err := ReadLocalCatalogDump(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return dump.Services, nil
+}
+
+// ReadLocalCatalogDump reads the local catalog like ReadLocalCatalog, together with the metadata
+// when the file is the catalog dump
+func ReadLocalCatalogDump(filePath string) (*CatalogDump, error) {
+	var input io.Reader = os.Stdin
+	if filePath != StdinPath {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read local catalog file: %w", err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	buffered := bufio.NewReader(input)
+	var reader io.Reader = buffered
+	if magic, _ := buffered.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip compressed local catalog: %w", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	res, err := DecodeCatalogDump(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal catalog from local file: %w", err)
+	}
+
+	return res, nil
+}
+
+// DecodeCatalog decodes the JSON array one item at a time. Items may be the output of the catalog endpoint
+// (`/v1/catalog/service/<name>`) or the health endpoint (`/v1/health/service/<name>`), the format is detected
+// for every item.
+func DecodeCatalog(r io.Reader) ([]*consulapi.CatalogService, error) {
+	dump, err := DecodeCatalogDump(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return dump.Services, nil
+}
+
+// DecodeCatalogDump decodes the JSON array of services, see DecodeCatalog, or the catalog dump object
+// written by WriteCatalogDump. The array has no metadata.
+func DecodeCatalogDump(r io.Reader) (*CatalogDump, error) {
+	decoder := json.NewDecoder(r)
+
+	token, err := decoder.Token()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read local catalog file: %w", err)
+		return nil, err
 	}
 
+	switch token {
+	case json.Delim('['):
+		services, err := decodeServices(decoder)
+		if err != nil {
+			return nil, err
+		}
+
+		return &CatalogDump{Services: services}, nil
+	case json.Delim('{'):
+		return decodeDump(decoder)
+	default:
+		return nil, fmt.Errorf("expected JSON array of services or the catalog dump, got %v", token)
+	}
+}
+
+// decodeDump decodes fields of the catalog dump object, services are decoded one at a time
+func decodeDump(decoder *json.Decoder) (*CatalogDump, error) {
+	dump := &CatalogDump{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		var fieldErr error
+		switch token {
+		case "Services":
+			var delim json.Token
+			if delim, fieldErr = decoder.Token(); fieldErr == nil && delim != json.Delim('[') {
+				fieldErr = fmt.Errorf("expected JSON array, got %v", delim)
+			}
+			if fieldErr == nil {
+				dump.Services, fieldErr = decodeServices(decoder)
+			}
+		case "FetchedAt":
+			fieldErr = decoder.Decode(&dump.FetchedAt)
+		case "Datacenters":
+			fieldErr = decoder.Decode(&dump.Datacenters)
+		default:
+			fieldErr = decoder.Decode(&json.RawMessage{})
+		}
+		if fieldErr != nil {
+			return nil, fmt.Errorf("catalog dump %v: %w", token, fieldErr)
+		}
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	if dump.Services == nil {
+		return nil, fmt.Errorf("catalog dump has no Services, expected JSON array of services or the catalog dump")
+	}
+
+	return dump, nil
+}
+
+// decodeServices decodes items of the JSON array which opening bracket is already read
+func decodeServices(decoder *json.Decoder) ([]*consulapi.CatalogService, error) {
 	res := []*consulapi.CatalogService{}
-	if err := json.Unmarshal(data, &res); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal catalog rom local file: %w", err)
+	for idx := 0; decoder.More(); idx++ {
+		item := json.RawMessage{}
+		if err := decoder.Decode(&item); err != nil {
+			return nil, fmt.Errorf("item %d: %w", idx, err)
+		}
+
+		service, err := decodeCatalogItem(item)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %w", idx, err)
+		}
+		res = append(res, service)
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
 	}
 
 	return res, nil
 }
+
+// decodeCatalogItem decodes the catalog item. The health endpoint item has the Node and Service objects,
+// the catalog endpoint item has the Node name.
+func decodeCatalogItem(item json.RawMessage) (*consulapi.CatalogService, error) {
+	probe := struct {
+		Node    json.RawMessage
+		Service json.RawMessage
+	}{}
+	if err := json.Unmarshal(item, &probe); err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(probe.Node), []byte("{")) && len(probe.Service) > 0 {
+		entry := &consulapi.ServiceEntry{}
+		if err := json.Unmarshal(item, entry); err != nil {
+			return nil, err
+		}
+
+		return serviceEntryToCatalogService(entry), nil
+	}
+
+	service := &consulapi.CatalogService{}
+	if err := json.Unmarshal(item, service); err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
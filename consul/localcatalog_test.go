@@ -0,0 +1,144 @@
+package consul_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daniel1302/fw-manager/consul"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const healthEndpointData = `[
+  {
+    "Node": {"ID": "b27a1a90-dff4-4ff8-9fe8-cc3b573a85b7", "Node": "node-01.eu-dc1.metrics.prod", "Address": "192.168.1.17", "Datacenter": "eu-dc1"},
+    "Service": {"ID": "wireguard", "Service": "wireguard", "Tags": ["metrics.prod"], "Address": "10.10.0.17", "Port": 51820},
+    "Checks": [{"CheckID": "serfHealth", "Status": "passing"}]
+  }
+]`
+
+const catalogEndpointData = `[
+  {
+    "ID": "b27a1a90-dff4-4ff8-9fe8-cc3b573a85b7",
+    "Node": "node-01.eu-dc1.metrics.prod",
+    "Address": "192.168.1.17",
+    "Datacenter": "eu-dc1",
+    "ServiceID": "wireguard",
+    "ServiceName": "wireguard",
+    "ServiceTags": ["metrics.prod"],
+    "ServiceAddress": "10.10.0.17",
+    "ServicePort": 51820
+  }
+]`
+
+func TestReadLocalCatalog(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, data string, compress bool) string {
+		path := filepath.Join(dir, name)
+		file, err := os.Create(path)
+		require.NoError(t, err)
+		defer file.Close()
+
+		if !compress {
+			_, err = file.WriteString(data)
+			require.NoError(t, err)
+			return path
+		}
+
+		gzipWriter := gzip.NewWriter(file)
+		_, err = gzipWriter.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, gzipWriter.Close())
+
+		return path
+	}
+
+	assertService := func(t *testing.T, services []*consulapi.CatalogService) {
+		require.Len(t, services, 1)
+		assert.Equal(t, "b27a1a90-dff4-4ff8-9fe8-cc3b573a85b7", services[0].ID)
+		assert.Equal(t, "node-01.eu-dc1.metrics.prod", services[0].Node)
+		assert.Equal(t, "wireguard", services[0].ServiceName)
+		assert.Equal(t, "10.10.0.17", services[0].ServiceAddress)
+		assert.Equal(t, []string{"metrics.prod"}, services[0].ServiceTags)
+	}
+
+	testCases := []struct {
+		name     string
+		data     string
+		compress bool
+	}{
+		{name: "Catalog endpoint", data: catalogEndpointData},
+		{name: "Health endpoint", data: healthEndpointData},
+		{name: "Gzip compressed catalog endpoint", data: catalogEndpointData, compress: true},
+		{name: "Gzip compressed health endpoint", data: healthEndpointData, compress: true},
+	}
+	for idx, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			services, err := consul.ReadLocalCatalog(writeFile(fmt.Sprintf("catalog-%d.json", idx), tc.data, tc.compress))
+			require.NoError(t, err)
+			assertService(t, services)
+		})
+	}
+
+	t.Run("Health checks are kept", func(t *testing.T) {
+		services, err := consul.ReadLocalCatalog(writeFile("health.json", healthEndpointData, false))
+		require.NoError(t, err)
+		assert.Equal(t, consulapi.HealthPassing, services[0].Checks.AggregatedStatus())
+	})
+
+	t.Run("Standard input", func(t *testing.T) {
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+
+		file, err := os.Open(writeFile("stdin.json", healthEndpointData, true))
+		require.NoError(t, err)
+		defer file.Close()
+		os.Stdin = file
+
+		services, err := consul.ReadLocalCatalog(consul.StdinPath)
+		require.NoError(t, err)
+		assertService(t, services)
+	})
+
+	t.Run("Catalog dump", func(t *testing.T) {
+		fetchedAt := time.Date(2024, 9, 16, 10, 0, 0, 0, time.UTC)
+		services, err := consul.DecodeCatalog(strings.NewReader(catalogEndpointData))
+		require.NoError(t, err)
+
+		for _, compress := range []bool{false, true} {
+			buf := bytes.Buffer{}
+			require.NoError(t, consul.WriteCatalogDump(&buf, consul.NewCatalogDump(&consul.FleetCatalog{
+				Services:    services,
+				Datacenters: []consul.DatacenterMetadata{{Name: "eu-dc1", FetchedAt: fetchedAt, Index: 42}},
+			}, fetchedAt)))
+
+			dump, err := consul.ReadLocalCatalogDump(writeFile(fmt.Sprintf("dump-%t.json", compress), buf.String(), compress))
+			require.NoError(t, err)
+			assertService(t, dump.Services)
+			assert.Equal(t, fetchedAt, dump.FetchedAt)
+			assert.Equal(t, []consul.DatacenterMetadata{{Name: "eu-dc1", FetchedAt: fetchedAt, Index: 42}}, dump.Datacenters)
+
+			services, err := consul.ReadLocalCatalog(writeFile("dump.json", buf.String(), compress))
+			require.NoError(t, err)
+			assertService(t, services)
+		}
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		_, err := consul.ReadLocalCatalog(writeFile("object.json", `{"Node": "node-01"}`, false))
+		assert.ErrorContains(t, err, "expected JSON array")
+
+		_, err = consul.ReadLocalCatalog(writeFile("truncated.json", catalogEndpointData[:100], false))
+		assert.Error(t, err)
+
+		_, err = consul.ReadLocalCatalog(writeFile("dump-object.json", `{"FetchedAt": "2024-09-16T10:00:00Z", "Services": {}}`, false))
+		assert.ErrorContains(t, err, "catalog dump Services")
+	})
+}
@@ -1,29 +1,117 @@
 package consul
 
 import (
+	"errors"
+	"log"
+	"net"
+
 	"github.com/daniel1302/fw-manager/types"
 	consulapi "github.com/hashicorp/consul/api"
 )
 
+// Normalizer converts the consul catalog to the fleet catalog
+type Normalizer struct {
+	classifier    *Classifier
+	addressPolicy AddressPolicy
+	// network is the managed network, addresses outside of it are reported
+	network *net.IPNet
+	// strict makes the normalization fail on validation errors instead of skipping invalid instances
+	strict bool
+}
+
+func NewNormalizer() *Normalizer {
+	return &Normalizer{
+		classifier:    DefaultClassifier(),
+		addressPolicy: DefaultAddressPolicy(),
+	}
+}
+
+// SetClassifier sets strategies the fleet type is found with
+func (normalizer *Normalizer) SetClassifier(classifier *Classifier) {
+	normalizer.classifier = classifier
+}
+
+// SetAddressPolicy sets the order the instance address is resolved in
+func (normalizer *Normalizer) SetAddressPolicy(policy AddressPolicy) {
+	normalizer.addressPolicy = policy
+}
+
+// SetNetwork sets the managed network instance addresses are validated against
+func (normalizer *Normalizer) SetNetwork(network *net.IPNet) {
+	normalizer.network = network
+}
+
+// SetStrict makes the normalization fail with the ValidationError when the catalog is inconsistent,
+// e.g: instance without address or the address used by multiple nodes
+func (normalizer *Normalizer) SetStrict(strict bool) {
+	normalizer.strict = strict
+}
+
 // NormalizeCatalog prepares fleet catalog in more friendly for later operations format.
 func NormalizeCatalog(catalog []*consulapi.CatalogService) (types.FleetCatalog, error) {
+	return NewNormalizer().Normalize(catalog)
+}
+
+// Normalize prepares fleet catalog in more friendly for later operations format.
+// Validation issues and instances classified differently by strategies are logged. Instances without
+// the valid address are skipped. The address used by multiple nodes is kept for the first node by name,
+// instances of other nodes are skipped. In the strict mode validation errors fail the normalization.
+func (normalizer *Normalizer) Normalize(catalog []*consulapi.CatalogService) (types.FleetCatalog, error) {
 	if len(catalog) < 1 {
 		return types.FleetCatalog{}, nil // Nothing to do?
 	}
 
+	validationErr := &ValidationError{}
+	// addressOwners maps the address used by multiple nodes to the node it is kept for
+	addressOwners := map[string]string{}
+	for _, issue := range normalizer.Validate(catalog) {
+		if normalizer.strict && issue.Severity == SeverityError {
+			validationErr.Issues = append(validationErr.Issues, issue)
+			continue
+		}
+		if errors.Is(issue, ErrDuplicateAddress) {
+			node := issue.Datacenter + "/" + issue.Node
+			if owner, found := addressOwners[issue.Address]; !found || node < owner {
+				addressOwners[issue.Address] = node
+			}
+		}
+		log.Printf("WARNING: invalid catalog instance: %s", issue)
+	}
+	if len(validationErr.Issues) > 0 {
+		return nil, validationErr
+	}
+
+	for _, conflict := range normalizer.classifier.Conflicts(catalog) {
+		log.Printf("WARNING: classification conflict: %s", conflict)
+	}
+
 	result := types.FleetCatalog{}
 
 	for _, service := range catalog {
-		serviceType := types.FleetTagsToFleetType(service.ServiceTags)
+		// instance without the valid address never gets a correct rule
+		address, addressSource := normalizer.addressPolicy.Resolve(service)
+		if net.ParseIP(address) == nil {
+			continue
+		}
+		node := service.Datacenter + "/" + service.Node
+		if owner, duplicated := addressOwners[address]; duplicated && owner != node {
+			log.Printf("WARNING: skipped instance %s of the %s node, address %s is kept for the %s node",
+				service.ServiceID, node, address, owner)
+			continue
+		}
+
+		serviceType := normalizer.classifier.Classify(service)
 
 		if _, fleetTypeDefined := result[serviceType]; !fleetTypeDefined {
 			result[serviceType] = []types.FleetItem{}
 		}
 		result[serviceType] = append(result[serviceType], types.FleetItem{
-			Type:    serviceType,
-			ID:      service.ID,
-			Node:    service.Node,
-			Address: service.ServiceAddress,
+			Type:          serviceType,
+			ID:            service.ID,
+			Node:          service.Node,
+			Address:       address,
+			Service:       service.ServiceName,
+			AddressSource: string(addressSource),
 		})
 	}
 
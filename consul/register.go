@@ -0,0 +1,66 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	// SelfServiceName is the service fw-manager registers itself as on the local agent
+	SelfServiceName = "fw-manager"
+	// selfCheckID is the TTL check reporting if rules of this host are in sync with the catalog
+	selfCheckID = "fw-manager:rules"
+)
+
+// RegisterSelf registers the fw-manager service with the TTL check on the local agent. The check goes critical
+// when it is not updated within the ttl, e.g: the process is stuck.
+func (api *ConsulAPIClient) RegisterSelf(ttl time.Duration, status string, output string) error {
+	if api.client == nil {
+		return ErrMissingConsulClient
+	}
+
+	registration := &consulapi.AgentServiceRegistration{
+		ID:   SelfServiceName,
+		Name: SelfServiceName,
+		Check: &consulapi.AgentServiceCheck{
+			CheckID: selfCheckID,
+			Name:    "Firewall rules in sync",
+			TTL:     ttl.String(),
+			Status:  status,
+			Notes:   "passing: rules are in sync, warning: drift was found and fixed, critical: the last apply failed",
+		},
+	}
+	if err := api.client.Agent().ServiceRegister(registration); err != nil {
+		return fmt.Errorf("failed to register the %s service: %w", SelfServiceName, err)
+	}
+
+	return api.UpdateSelfCheck(status, output)
+}
+
+// UpdateSelfCheck reports the status of the last run, it must be called more often than the check ttl
+func (api *ConsulAPIClient) UpdateSelfCheck(status string, output string) error {
+	if api.client == nil {
+		return ErrMissingConsulClient
+	}
+
+	if err := api.client.Agent().UpdateTTL(selfCheckID, output, status); err != nil {
+		return fmt.Errorf("failed to update the %s check: %w", selfCheckID, err)
+	}
+
+	return nil
+}
+
+// DeregisterSelf removes the fw-manager service and its check from the local agent
+func (api *ConsulAPIClient) DeregisterSelf() error {
+	if api.client == nil {
+		return ErrMissingConsulClient
+	}
+
+	if err := api.client.Agent().ServiceDeregister(SelfServiceName); err != nil {
+		return fmt.Errorf("failed to deregister the %s service: %w", SelfServiceName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package consul_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daniel1302/fw-manager/consul"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterSelf(t *testing.T) {
+	mu := sync.Mutex{}
+	requests := []string{}
+	registration := consulapi.AgentServiceRegistration{}
+	updates := []map[string]string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/v1/agent/service/register":
+			json.NewDecoder(r.Body).Decode(&registration)
+		case "/v1/agent/check/update/fw-manager:rules":
+			update := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&update)
+			updates = append(updates, update)
+		}
+	}))
+	defer server.Close()
+
+	client, err := consulapi.NewClient(&consulapi.Config{Address: server.URL})
+	require.NoError(t, err)
+	api, err := consul.NewConsulAPIClient(client)
+	require.NoError(t, err)
+
+	require.NoError(t, api.RegisterSelf(time.Minute, consulapi.HealthPassing, "Rules in sync"))
+	require.NoError(t, api.UpdateSelfCheck(consulapi.HealthWarning, "Drift found and fixed"))
+	require.NoError(t, api.DeregisterSelf())
+
+	assert.Equal(t, []string{
+		"PUT /v1/agent/service/register",
+		"PUT /v1/agent/check/update/fw-manager:rules",
+		"PUT /v1/agent/check/update/fw-manager:rules",
+		"PUT /v1/agent/service/deregister/fw-manager",
+	}, requests)
+
+	assert.Equal(t, "fw-manager", registration.Name)
+	require.NotNil(t, registration.Check)
+	assert.Equal(t, "fw-manager:rules", registration.Check.CheckID)
+	assert.Equal(t, "1m0s", registration.Check.TTL)
+	assert.Equal(t, consulapi.HealthPassing, registration.Check.Status)
+
+	assert.Equal(t, []map[string]string{
+		{"Status": consulapi.HealthPassing, "Output": "Rules in sync"},
+		{"Status": consulapi.HealthWarning, "Output": "Drift found and fixed"},
+	}, updates)
+
+	assert.Error(t, api.UpdateSelfCheck("unknown", ""))
+}
@@ -0,0 +1,151 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/daniel1302/fw-manager/types"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+var (
+	ErrEmptyAddress     error = fmt.Errorf("empty address")
+	ErrInvalidAddress   error = fmt.Errorf("invalid address")
+	ErrDuplicateAddress error = fmt.Errorf("address used by multiple nodes")
+	ErrOutsideNetwork   error = fmt.Errorf("address outside the managed network")
+	ErrUnknownFleetType error = fmt.Errorf("unknown fleet type")
+)
+
+type Severity string
+
+const (
+	// SeverityError makes the catalog inconsistent, the instance can not get correct rules
+	SeverityError Severity = "error"
+	// SeverityWarning is suspicious, but does not affect rules of other instances
+	SeverityWarning Severity = "warning"
+)
+
+// ValidationIssue is the problem found in one catalog instance, errors.Is matches it with the Err
+type ValidationIssue struct {
+	Err        error
+	Severity   Severity
+	Datacenter string
+	Node       string
+	ServiceID  string
+	Address    string
+	// Details are optional, e.g: other nodes using the same address
+	Details string
+}
+
+func (issue ValidationIssue) Error() string {
+	message := fmt.Sprintf("%s/%s/%s: %s, address: %q", issue.Datacenter, issue.Node, issue.ServiceID, issue.Err, issue.Address)
+	if issue.Details != "" {
+		message += ", " + issue.Details
+	}
+
+	return message
+}
+
+func (issue ValidationIssue) Unwrap() error {
+	return issue.Err
+}
+
+// ValidationError aggregates validation issues of the catalog
+type ValidationError struct {
+	Issues []ValidationIssue
+}
+
+func (validationErr *ValidationError) Error() string {
+	messages := make([]string, 0, len(validationErr.Issues))
+	for _, issue := range validationErr.Issues {
+		messages = append(messages, issue.Error())
+	}
+
+	return fmt.Sprintf("catalog has %d validation errors: %s", len(validationErr.Issues), strings.Join(messages, "; "))
+}
+
+func (validationErr *ValidationError) Unwrap() []error {
+	result := make([]error, 0, len(validationErr.Issues))
+	for _, issue := range validationErr.Issues {
+		result = append(result, issue)
+	}
+
+	return result
+}
+
+// Validate checks addresses, resolved with the address policy, and fleet types of catalog instances.
+// Instances of the same node may share the address, e.g: multiple services, different nodes may not.
+func (normalizer *Normalizer) Validate(catalog []*consulapi.CatalogService) []ValidationIssue {
+	result := []ValidationIssue{}
+	nodesByAddress := map[string][]string{}
+	addresses := make([]string, len(catalog))
+
+	for idx, service := range catalog {
+		address, _ := normalizer.addressPolicy.Resolve(service)
+		addresses[idx] = address
+
+		issue := ValidationIssue{
+			Severity:   SeverityError,
+			Datacenter: service.Datacenter,
+			Node:       service.Node,
+			ServiceID:  service.ServiceID,
+			Address:    address,
+		}
+
+		ip := net.ParseIP(address)
+		switch {
+		case address == "":
+			issue.Err = ErrEmptyAddress
+			issue.Details = fmt.Sprintf("address policy: %v", normalizer.addressPolicy)
+			result = append(result, issue)
+		case ip == nil:
+			issue.Err = ErrInvalidAddress
+			result = append(result, issue)
+		default:
+			node := service.Datacenter + "/" + service.Node
+			if nodes := nodesByAddress[ip.String()]; !slices.Contains(nodes, node) {
+				nodesByAddress[ip.String()] = append(nodes, node)
+			}
+
+			if normalizer.network != nil && !normalizer.network.Contains(ip) {
+				issue.Err = ErrOutsideNetwork
+				issue.Severity = SeverityWarning
+				issue.Details = "network " + normalizer.network.String()
+				result = append(result, issue)
+			}
+		}
+
+		if normalizer.classifier.Classify(service) == types.FleetUnknown {
+			issue.Err = ErrUnknownFleetType
+			issue.Severity = SeverityWarning
+			issue.Details = ""
+			result = append(result, issue)
+		}
+	}
+
+	for idx, service := range catalog {
+		ip := net.ParseIP(addresses[idx])
+		if ip == nil {
+			continue
+		}
+
+		nodes := nodesByAddress[ip.String()]
+		if len(nodes) < 2 {
+			continue
+		}
+
+		result = append(result, ValidationIssue{
+			Err:        ErrDuplicateAddress,
+			Severity:   SeverityError,
+			Datacenter: service.Datacenter,
+			Node:       service.Node,
+			ServiceID:  service.ServiceID,
+			Address:    addresses[idx],
+			Details:    "nodes: " + strings.Join(nodes, ", "),
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,93 @@
+package consul_test
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/types"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateCatalog(t *testing.T) {
+	_, network, err := net.ParseCIDR("10.10.0.0/16")
+	require.NoError(t, err)
+
+	catalog := []*consulapi.CatalogService{
+		{Datacenter: "eu-dc1", Node: "node-01", ServiceID: "wireguard", ServiceAddress: "10.10.0.17", ServiceTags: []string{"metrics.prod"}},
+		// the same node may register multiple services with the same address
+		{Datacenter: "eu-dc1", Node: "node-01", ServiceID: "node-exporter", ServiceAddress: "10.10.0.17", ServiceTags: []string{"metrics.prod"}},
+		{Datacenter: "eu-dc1", Node: "node-02", ServiceID: "wireguard", ServiceAddress: "", ServiceTags: []string{"logs.prod"}},
+		{Datacenter: "eu-dc1", Node: "node-03", ServiceID: "wireguard", ServiceAddress: "10.10.0", ServiceTags: []string{"logs.prod"}},
+		{Datacenter: "us-dc", Node: "node-04", ServiceID: "wireguard", ServiceAddress: "10.10.0.18", ServiceTags: []string{"app.prod"}},
+		{Datacenter: "us-dc", Node: "node-05", ServiceID: "wireguard", ServiceAddress: "10.10.0.18", ServiceTags: []string{"app.prod"}},
+		{Datacenter: "us-dc", Node: "node-06", ServiceID: "wireguard", ServiceAddress: "192.168.1.6"},
+	}
+
+	t.Run("Issues are typed", func(t *testing.T) {
+		normalizer := consul.NewNormalizer()
+		normalizer.SetNetwork(network)
+		issues := normalizer.Validate(catalog)
+
+		found := map[string][]string{}
+		for _, issue := range issues {
+			found[issue.Node] = append(found[issue.Node], issue.Err.Error()+"/"+string(issue.Severity))
+		}
+		assert.Equal(t, map[string][]string{
+			"node-02": {"empty address/error"},
+			"node-03": {"invalid address/error"},
+			"node-04": {"address used by multiple nodes/error"},
+			"node-05": {"address used by multiple nodes/error"},
+			"node-06": {"address outside the managed network/warning", "unknown fleet type/warning"},
+		}, found)
+
+		assert.True(t, errors.Is(issues[0], consul.ErrEmptyAddress))
+		assert.Contains(t, issues[len(issues)-1].Error(), "nodes: us-dc/node-04, us-dc/node-05")
+	})
+
+	t.Run("Strict mode refuses inconsistent catalog", func(t *testing.T) {
+		normalizer := consul.NewNormalizer()
+		normalizer.SetNetwork(network)
+		normalizer.SetStrict(true)
+
+		_, err := normalizer.Normalize(catalog)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, consul.ErrEmptyAddress)
+		assert.ErrorIs(t, err, consul.ErrInvalidAddress)
+		assert.ErrorIs(t, err, consul.ErrDuplicateAddress)
+		// warnings do not fail the strict mode
+		assert.NotErrorIs(t, err, consul.ErrOutsideNetwork)
+
+		validationErr := &consul.ValidationError{}
+		require.ErrorAs(t, err, &validationErr)
+		assert.Len(t, validationErr.Issues, 4)
+
+		normalizedCatalog, err := normalizer.Normalize(catalog[:2])
+		require.NoError(t, err)
+		assert.Len(t, normalizedCatalog[types.FleetMetrics], 2)
+	})
+
+	t.Run("Instances without valid or unique address are skipped", func(t *testing.T) {
+		normalizedCatalog, err := consul.NormalizeCatalog(catalog)
+		require.NoError(t, err)
+		assert.Empty(t, normalizedCatalog[types.FleetLogs])
+		// address used by multiple nodes is kept for the first node
+		require.Len(t, normalizedCatalog[types.FleetApp], 1)
+		assert.Equal(t, "node-04", normalizedCatalog[types.FleetApp][0].Node)
+		assert.Equal(t, "10.10.0.18", normalizedCatalog[types.FleetApp][0].Address)
+		assert.Len(t, normalizedCatalog[types.FleetMetrics], 2)
+		assert.Len(t, normalizedCatalog[types.FleetUnknown], 1)
+
+		// the kept node does not depend on the catalog order
+		reversed := slices.Clone(catalog)
+		slices.Reverse(reversed)
+		normalizedCatalog, err = consul.NormalizeCatalog(reversed)
+		require.NoError(t, err)
+		require.Len(t, normalizedCatalog[types.FleetApp], 1)
+		assert.Equal(t, "node-04", normalizedCatalog[types.FleetApp][0].Node)
+	})
+}
@@ -0,0 +1,149 @@
+package consul
+
+import (
+	"context"
+	"log"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	DefaultWatchWaitTime = 5 * time.Minute
+	DefaultWatchDebounce = 5 * time.Second
+	DefaultMinBackoff    = time.Second
+	DefaultMaxBackoff    = time.Minute
+)
+
+type WatchConfig struct {
+	// WaitTime is the longest time the blocking query waits for a change
+	WaitTime time.Duration
+	// Debounce is how long the catalog must stay unchanged before the change is reported
+	Debounce time.Duration
+	// MinBackoff and MaxBackoff limit the delay before the failed query is retried
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Resync reports the change periodically even when the catalog does not change, 0 disables it
+	Resync time.Duration
+}
+
+func DefaultWatchConfig() WatchConfig {
+	return WatchConfig{
+		WaitTime:   DefaultWatchWaitTime,
+		Debounce:   DefaultWatchDebounce,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
+// WatchFleetCatalog watches the catalog of the configured services in given datacenters with blocking queries
+// and calls the onChange after the catalog changes. Changes in short succession are reported once,
+// when the catalog stays unchanged for the debounce time. The onChange is never called concurrently.
+// The watch runs until the context is cancelled.
+func (api *ConsulAPIClient) WatchFleetCatalog(
+	ctx context.Context,
+	datacenters []string,
+	config WatchConfig,
+	onChange func(),
+) error {
+	if api.client == nil {
+		return ErrMissingConsulClient
+	}
+
+	changes := make(chan struct{}, 1)
+	for _, dc := range datacenters {
+		for _, service := range api.services {
+			go api.watchService(ctx, dc, service, config, changes)
+		}
+	}
+
+	debounce := time.NewTimer(config.Debounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	var resync <-chan time.Time
+	if config.Resync > 0 {
+		ticker := time.NewTicker(config.Resync)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changes:
+			debounce.Reset(config.Debounce)
+		case <-debounce.C:
+			onChange()
+		case <-resync:
+			onChange()
+		}
+	}
+}
+
+// watchService runs the blocking queries for the service in one datacenter and notifies the changes channel
+// when the catalog index moves. The first query only sets the index.
+func (api *ConsulAPIClient) watchService(ctx context.Context, dc string, service string, config WatchConfig, changes chan<- struct{}) {
+	var index uint64
+	backoff := config.MinBackoff
+
+	for {
+		opts := (&consulapi.QueryOptions{
+			Datacenter: dc,
+			WaitIndex:  index,
+			WaitTime:   config.WaitTime,
+		}).WithContext(ctx)
+
+		_, meta, err := api.serviceInstances(service, opts)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to watch the \"%s\" service in %s DC, retrying in %s: %s", service, dc, backoff, err)
+			if !sleepContext(ctx, backoff) {
+				return
+			}
+			backoff = min(backoff*2, config.MaxBackoff)
+			continue
+		}
+		backoff = config.MinBackoff
+
+		newIndex, changed := nextWaitIndex(index, meta.LastIndex)
+		if changed && index != 0 {
+			select {
+			case changes <- struct{}{}:
+			default: // change is already pending
+			}
+		}
+		index = newIndex
+	}
+}
+
+// nextWaitIndex returns index for the next blocking query and checks if the catalog changed.
+// Index going backwards means the consul state was reset, e.g: restored from the snapshot,
+// so the watch starts over and the catalog is treated as changed.
+func nextWaitIndex(current uint64, lastIndex uint64) (uint64, bool) {
+	switch {
+	case lastIndex < current:
+		return 0, true
+	case lastIndex == 0:
+		// consul never returns 0 index for existing data, query with 0 index does not block
+		return 1, current != 1
+	default:
+		return lastIndex, lastIndex != current
+	}
+}
+
+// sleepContext waits given time and returns false when the context is cancelled before
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,149 @@
+package consul_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daniel1302/fw-manager/consul"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConsul serves the catalog of the primary service with the blocking query semantics
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	failures int
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 10, changed: make(chan struct{})}
+}
+
+// setIndex changes the catalog index and wakes up the blocked queries
+func (f *fakeConsul) setIndex(index uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.index = index
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/catalog/service/"+consul.PrimaryServiceName {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	if f.failures > 0 {
+		f.failures--
+		f.mu.Unlock()
+		http.Error(w, "rpc error: no leader", http.StatusInternalServerError)
+		return
+	}
+	index, changed := f.index, f.changed
+	f.mu.Unlock()
+
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if waitIndex != 0 && waitIndex == index {
+		wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+		if err != nil {
+			wait = 5 * time.Minute
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+
+		f.mu.Lock()
+		index = f.index
+		f.mu.Unlock()
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode([]*consulapi.CatalogService{})
+}
+
+func TestWatchFleetCatalog(t *testing.T) {
+	fake := newFakeConsul()
+	fake.failures = 2
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := consulapi.NewClient(&consulapi.Config{Address: server.URL})
+	require.NoError(t, err)
+	api, err := consul.NewConsulAPIClient(client)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := make(chan struct{}, 10)
+	var callsCount atomic.Int32
+	done := make(chan error)
+	go func() {
+		done <- api.WatchFleetCatalog(ctx, []string{"dc1"}, consul.WatchConfig{
+			WaitTime:   time.Second,
+			Debounce:   100 * time.Millisecond,
+			MinBackoff: 10 * time.Millisecond,
+			MaxBackoff: 50 * time.Millisecond,
+		}, func() {
+			callsCount.Add(1)
+			calls <- struct{}{}
+		})
+	}()
+
+	waitForCall := func() {
+		select {
+		case <-calls:
+		case <-time.After(5 * time.Second):
+			t.Fatal("catalog change was not reported")
+		}
+	}
+
+	// the watch has to get the index after the failed queries, before the catalog changes
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int32(0), callsCount.Load(), "the first query must not report the change")
+
+	t.Run("Changes in short succession are reported once", func(t *testing.T) {
+		fake.setIndex(11)
+		time.Sleep(20 * time.Millisecond)
+		fake.setIndex(12)
+		time.Sleep(20 * time.Millisecond)
+		fake.setIndex(13)
+
+		waitForCall()
+		time.Sleep(300 * time.Millisecond)
+		assert.Equal(t, int32(1), callsCount.Load())
+	})
+
+	t.Run("Index reset is reported", func(t *testing.T) {
+		fake.setIndex(3)
+
+		waitForCall()
+		assert.Equal(t, int32(2), callsCount.Load())
+	})
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not stop after the context was cancelled")
+	}
+}
@@ -0,0 +1,45 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/types"
+)
+
+// ConsulFileSource reads the fleet from the local consul catalog file, see consul.ReadLocalCatalog
+type ConsulFileSource struct {
+	path       string
+	normalizer *consul.Normalizer
+}
+
+func NewConsulFileSource(path string, normalizer *consul.Normalizer) *ConsulFileSource {
+	return &ConsulFileSource{
+		path:       path,
+		normalizer: normalizer,
+	}
+}
+
+func (source *ConsulFileSource) Name() string {
+	return "consul-file"
+}
+
+func (source *ConsulFileSource) Catalog(_ context.Context) (types.FleetCatalog, error) {
+	dump, err := consul.ReadLocalCatalogDump(source.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consul catalog from local file: %w", err)
+	}
+	if !dump.FetchedAt.IsZero() {
+		log.Printf("Using the catalog dump fetched at %s from %d data-centers", dump.FetchedAt.Format(time.RFC3339), len(dump.Datacenters))
+	}
+
+	normalizedCatalog, err := source.normalizer.Normalize(dump.Services)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize local consul catalog: %w", err)
+	}
+
+	return normalizedCatalog, nil
+}
@@ -0,0 +1,99 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/daniel1302/fw-manager/types"
+)
+
+// DNSRecord is the SRV record listing hosts of one fleet type
+type DNSRecord struct {
+	// Name is the full SRV record name, e.g: _wireguard._udp.metrics.prod.example.com
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+}
+
+// srvResolver is the part of the net.Resolver used by the DNSSource
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSSource discovers the fleet with DNS SRV lookups, every IPv4 address of the SRV target is the fleet item
+type DNSSource struct {
+	resolver srvResolver
+	records  []DNSRecord
+}
+
+// NewDNSSource creates the source querying the given resolver, e.g: 10.0.0.2:53. Empty resolver address
+// means the system resolver.
+func NewDNSSource(resolverAddress string, records []DNSRecord) *DNSSource {
+	return &DNSSource{
+		resolver: newResolver(resolverAddress),
+		records:  records,
+	}
+}
+
+func newResolver(address string) srvResolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+func (source *DNSSource) Name() string {
+	return "dns"
+}
+
+func (source *DNSSource) Catalog(ctx context.Context) (types.FleetCatalog, error) {
+	result := types.FleetCatalog{}
+	for _, record := range source.records {
+		fleetType, err := types.ParseFleetType(record.Type)
+		if err != nil {
+			return nil, fmt.Errorf("invalid type of the %s record: %w", record.Name, err)
+		}
+
+		_, targets, err := source.resolver.LookupSRV(ctx, "", "", record.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup %s SRV record: %w", record.Name, err)
+		}
+
+		for _, target := range targets {
+			addresses, err := source.resolver.LookupIPAddr(ctx, target.Target)
+			if err != nil {
+				return nil, fmt.Errorf("failed to lookup address of %s from the %s SRV record: %w", target.Target, record.Name, err)
+			}
+
+			node := strings.TrimSuffix(target.Target, ".")
+			for _, address := range addresses {
+				if address.IP.To4() == nil {
+					continue
+				}
+
+				result.Add(types.FleetItem{
+					Type:          fleetType,
+					ID:            node,
+					Node:          node,
+					Address:       address.IP.String(),
+					Service:       record.Name,
+					AddressSource: "dns",
+				})
+			}
+		}
+	}
+
+	return result, nil
+}
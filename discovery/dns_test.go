@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/daniel1302/fw-manager/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver struct {
+	srv   map[string][]*net.SRV
+	hosts map[string][]net.IPAddr
+}
+
+func (resolver fakeResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	targets, ok := resolver.srv[name]
+	if !ok {
+		return "", nil, fmt.Errorf("no such host")
+	}
+	return name, targets, nil
+}
+
+func (resolver fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	addresses, ok := resolver.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host")
+	}
+	return addresses, nil
+}
+
+func TestDNSSource(t *testing.T) {
+	resolver := fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_wireguard._udp.metrics.prod.example.com": {
+				{Target: "node-01.metrics.prod.example.com.", Port: 51820},
+				{Target: "node-02.metrics.prod.example.com.", Port: 51820},
+			},
+		},
+		hosts: map[string][]net.IPAddr{
+			"node-01.metrics.prod.example.com.": {{IP: net.ParseIP("10.10.0.17")}, {IP: net.ParseIP("fd00::17")}},
+			"node-02.metrics.prod.example.com.": {{IP: net.ParseIP("10.10.0.18")}},
+		},
+	}
+
+	t.Run("SRV targets are fleet items", func(t *testing.T) {
+		source := &DNSSource{
+			resolver: resolver,
+			records:  []DNSRecord{{Name: "_wireguard._udp.metrics.prod.example.com", Type: "metrics"}},
+		}
+
+		catalog, err := source.Catalog(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, types.FleetCatalog{
+			types.FleetMetrics: {
+				{
+					Type:          types.FleetMetrics,
+					ID:            "node-01.metrics.prod.example.com",
+					Node:          "node-01.metrics.prod.example.com",
+					Address:       "10.10.0.17",
+					Service:       "_wireguard._udp.metrics.prod.example.com",
+					AddressSource: "dns",
+				},
+				{
+					Type:          types.FleetMetrics,
+					ID:            "node-02.metrics.prod.example.com",
+					Node:          "node-02.metrics.prod.example.com",
+					Address:       "10.10.0.18",
+					Service:       "_wireguard._udp.metrics.prod.example.com",
+					AddressSource: "dns",
+				},
+			},
+		}, catalog)
+	})
+
+	t.Run("Failed lookup fails the source", func(t *testing.T) {
+		source := &DNSSource{
+			resolver: resolver,
+			records:  []DNSRecord{{Name: "_wireguard._udp.logs.prod.example.com", Type: "logs"}},
+		}
+
+		_, err := source.Catalog(context.Background())
+		assert.ErrorContains(t, err, "failed to lookup _wireguard._udp.logs.prod.example.com SRV record")
+	})
+
+	t.Run("Unknown fleet type", func(t *testing.T) {
+		source := &DNSSource{
+			resolver: resolver,
+			records:  []DNSRecord{{Name: "_wireguard._udp.metrics.prod.example.com", Type: "database"}},
+		}
+
+		_, err := source.Catalog(context.Background())
+		assert.ErrorContains(t, err, "unknown fleet type")
+	})
+}
@@ -0,0 +1,127 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"slices"
+
+	"github.com/daniel1302/fw-manager/types"
+)
+
+// FilterConfig selects fleet items of the source on the client side, empty fields match all items
+type FilterConfig struct {
+	// Types are fleet types of selected items
+	Types []string `yaml:"types"`
+	// Node is the regexp the node name must match
+	Node string `yaml:"node"`
+	// Services are names of services of selected items
+	Services []string `yaml:"services"`
+	// Network is the CIDR the item address must belong to
+	Network string `yaml:"network"`
+}
+
+// ItemFilter is the compiled FilterConfig
+type ItemFilter struct {
+	types    []types.FleetType
+	node     *regexp.Regexp
+	services []string
+	network  *net.IPNet
+}
+
+func NewItemFilter(config FilterConfig) (*ItemFilter, error) {
+	result := &ItemFilter{services: config.Services}
+
+	for _, name := range config.Types {
+		fleetType, err := types.ParseFleetType(name)
+		if err != nil {
+			return nil, err
+		}
+		result.types = append(result.types, fleetType)
+	}
+
+	if config.Node != "" {
+		node, err := regexp.Compile(config.Node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile node filter: %w", err)
+		}
+		result.node = node
+	}
+
+	if config.Network != "" {
+		_, network, err := net.ParseCIDR(config.Network)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse network filter: %w", err)
+		}
+		result.network = network
+	}
+
+	return result, nil
+}
+
+func (filter *ItemFilter) Match(item types.FleetItem) bool {
+	if len(filter.types) > 0 && !slices.Contains(filter.types, item.Type) {
+		return false
+	}
+	if filter.node != nil && !filter.node.MatchString(item.Node) {
+		return false
+	}
+	if len(filter.services) > 0 && !slices.Contains(filter.services, item.Service) {
+		return false
+	}
+	if filter.network != nil {
+		ip := net.ParseIP(item.Address)
+		if ip == nil || !filter.network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FilteredSource keeps only items of the source matching the filter
+type FilteredSource struct {
+	source CatalogSource
+	filter *ItemFilter
+}
+
+func NewFilteredSource(source CatalogSource, filter *ItemFilter) *FilteredSource {
+	return &FilteredSource{
+		source: source,
+		filter: filter,
+	}
+}
+
+func (filtered *FilteredSource) Name() string {
+	return filtered.source.Name()
+}
+
+// Unwrap returns the filtered source
+func (filtered *FilteredSource) Unwrap() CatalogSource {
+	return filtered.source
+}
+
+func (filtered *FilteredSource) Catalog(ctx context.Context) (types.FleetCatalog, error) {
+	catalog, err := filtered.source.Catalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := types.FleetCatalog{}
+	skipped := 0
+	for _, item := range sortedItems(catalog) {
+		if !filtered.filter.Match(item) {
+			skipped++
+			continue
+		}
+		result.Add(item)
+	}
+
+	if skipped > 0 {
+		log.Printf("Filtered out %d fleet items of the %s source", skipped, filtered.Name())
+	}
+
+	return result, nil
+}
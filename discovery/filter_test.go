@@ -0,0 +1,77 @@
+package discovery_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/daniel1302/fw-manager/discovery"
+	"github.com/daniel1302/fw-manager/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilteredSource(t *testing.T) {
+	source := staticSource{name: "inventory", catalog: types.FleetCatalog{
+		types.FleetMetrics: {
+			{Type: types.FleetMetrics, Node: "node-01.eu-dc1.metrics.prod", Address: "10.10.0.17", Service: "wireguard"},
+			{Type: types.FleetMetrics, Node: "node-02.eu-dc1.metrics.staging", Address: "10.10.0.18", Service: "wireguard"},
+			{Type: types.FleetMetrics, Node: "node-03.eu-dc1.metrics.prod", Address: "192.168.1.19", Service: "wireguard"},
+		},
+		types.FleetLogs: {
+			{Type: types.FleetLogs, Node: "node-04.eu-dc1.logs.prod", Address: "10.10.0.20", Service: "syslog"},
+		},
+	}}
+
+	testCases := []struct {
+		name     string
+		config   discovery.FilterConfig
+		expected []string
+	}{
+		{
+			name:     "empty filter",
+			expected: []string{"node-04.eu-dc1.logs.prod", "node-01.eu-dc1.metrics.prod", "node-02.eu-dc1.metrics.staging", "node-03.eu-dc1.metrics.prod"},
+		},
+		{
+			name:     "types",
+			config:   discovery.FilterConfig{Types: []string{"logs"}},
+			expected: []string{"node-04.eu-dc1.logs.prod"},
+		},
+		{
+			name:     "node and network",
+			config:   discovery.FilterConfig{Node: `\.prod$`, Network: "10.10.0.0/16"},
+			expected: []string{"node-04.eu-dc1.logs.prod", "node-01.eu-dc1.metrics.prod"},
+		},
+		{
+			name:     "services",
+			config:   discovery.FilterConfig{Services: []string{"wireguard"}, Node: "staging"},
+			expected: []string{"node-02.eu-dc1.metrics.staging"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := discovery.NewItemFilter(tc.config)
+			require.NoError(t, err)
+
+			filtered := discovery.NewFilteredSource(source, filter)
+			assert.Equal(t, "inventory", filtered.Name())
+
+			catalog, err := filtered.Catalog(context.Background())
+			require.NoError(t, err)
+
+			nodes := []string{}
+			for _, fleetType := range []types.FleetType{types.FleetLogs, types.FleetMetrics} {
+				for _, item := range catalog[fleetType] {
+					nodes = append(nodes, item.Node)
+				}
+			}
+			assert.Equal(t, tc.expected, nodes)
+		})
+	}
+
+	t.Run("Invalid filter", func(t *testing.T) {
+		for _, config := range []discovery.FilterConfig{{Types: []string{"database"}}, {Node: "("}, {Network: "10.10.0.0"}} {
+			_, err := discovery.NewItemFilter(config)
+			assert.Error(t, err)
+		}
+	})
+}
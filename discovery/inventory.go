@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/daniel1302/fw-manager/types"
+	"gopkg.in/yaml.v3"
+)
+
+// InventoryHost is the host listed in the static inventory
+type InventoryHost struct {
+	Node    string `yaml:"node"`
+	Address string `yaml:"address"`
+	Type    string `yaml:"type"`
+	// Service is optional, it is reported as the service the host was discovered as
+	Service string `yaml:"service"`
+}
+
+type inventory struct {
+	Hosts []InventoryHost `yaml:"hosts"`
+}
+
+// InventorySource reads the fleet from the static YAML inventory, e.g: hosts not registered in consul yet.
+//
+// Example:
+//
+//	hosts:
+//	  - node: node-01.eu-dc1.metrics.prod
+//	    address: 10.10.0.17
+//	    type: metrics
+type InventorySource struct {
+	path string
+}
+
+func NewInventorySource(path string) *InventorySource {
+	return &InventorySource{
+		path: path,
+	}
+}
+
+func (source *InventorySource) Name() string {
+	return "inventory"
+}
+
+// Catalog reads the inventory file on every call, so changes are picked up without restart
+func (source *InventorySource) Catalog(_ context.Context) (types.FleetCatalog, error) {
+	file, err := os.Open(source.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open inventory file: %w", err)
+	}
+	defer file.Close()
+
+	content := inventory{}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&content); err != nil {
+		return nil, fmt.Errorf("failed to parse inventory file %s: %w", source.path, err)
+	}
+
+	result := types.FleetCatalog{}
+	for idx, host := range content.Hosts {
+		item, err := host.fleetItem()
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %d in inventory file %s: %w", idx, source.path, err)
+		}
+		result.Add(item)
+	}
+
+	return result, nil
+}
+
+func (host InventoryHost) fleetItem() (types.FleetItem, error) {
+	if net.ParseIP(host.Address) == nil {
+		return types.FleetItem{}, fmt.Errorf("invalid address %q", host.Address)
+	}
+
+	fleetType, err := types.ParseFleetType(host.Type)
+	if err != nil {
+		return types.FleetItem{}, err
+	}
+
+	node := host.Node
+	if node == "" {
+		node = host.Address
+	}
+
+	return types.FleetItem{
+		Type:          fleetType,
+		ID:            node,
+		Node:          node,
+		Address:       host.Address,
+		Service:       host.Service,
+		AddressSource: "inventory",
+	}, nil
+}
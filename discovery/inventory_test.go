@@ -0,0 +1,59 @@
+package discovery_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/daniel1302/fw-manager/discovery"
+	"github.com/daniel1302/fw-manager/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInventorySource(t *testing.T) {
+	dir := t.TempDir()
+	writeInventory := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	t.Run("Valid inventory", func(t *testing.T) {
+		source := discovery.NewInventorySource(writeInventory("inventory.yaml", `
+hosts:
+  - node: node-01.eu-dc1.metrics.prod
+    address: 10.10.0.17
+    type: metrics
+  - address: 10.10.0.18
+    type: logs
+    service: syslog
+`))
+		catalog, err := source.Catalog(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, types.FleetCatalog{
+			types.FleetMetrics: {
+				{Type: types.FleetMetrics, ID: "node-01.eu-dc1.metrics.prod", Node: "node-01.eu-dc1.metrics.prod", Address: "10.10.0.17", AddressSource: "inventory"},
+			},
+			types.FleetLogs: {
+				{Type: types.FleetLogs, ID: "10.10.0.18", Node: "10.10.0.18", Address: "10.10.0.18", Service: "syslog", AddressSource: "inventory"},
+			},
+		}, catalog)
+	})
+
+	t.Run("Invalid inventory", func(t *testing.T) {
+		testCases := map[string]string{
+			"invalid address": "hosts:\n  - address: 10.10.0\n    type: metrics\n",
+			"unknown type":    "hosts:\n  - address: 10.10.0.17\n    type: database\n",
+			"unknown field":   "hosts:\n  - address: 10.10.0.17\n    type: metrics\n    port: 22\n",
+		}
+		for name, content := range testCases {
+			_, err := discovery.NewInventorySource(writeInventory(name+".yaml", content)).Catalog(context.Background())
+			assert.Error(t, err, name)
+		}
+
+		_, err := discovery.NewInventorySource(filepath.Join(dir, "missing.yaml")).Catalog(context.Background())
+		assert.Error(t, err)
+	})
+}
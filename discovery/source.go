@@ -0,0 +1,90 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/daniel1302/fw-manager/types"
+)
+
+// CatalogSource discovers the fleet, e.g: from the consul catalog or the static inventory
+type CatalogSource interface {
+	// Name identifies the source in logs and errors
+	Name() string
+	// Catalog returns the normalized fleet known to the source
+	Catalog(ctx context.Context) (types.FleetCatalog, error)
+}
+
+// CombinedSource merges fleets of multiple sources. Sources are in the priority order, when the same address
+// is known to multiple sources, the item from the source with the highest priority is used. Any failed source
+// fails the whole catalog, so peers known only to that source never lose their access.
+type CombinedSource struct {
+	sources []CatalogSource
+}
+
+func NewCombinedSource(sources ...CatalogSource) *CombinedSource {
+	return &CombinedSource{
+		sources: sources,
+	}
+}
+
+func (combined *CombinedSource) Name() string {
+	names := make([]string, 0, len(combined.sources))
+	for _, source := range combined.sources {
+		names = append(names, source.Name())
+	}
+
+	return fmt.Sprintf("%v", names)
+}
+
+func (combined *CombinedSource) Catalog(ctx context.Context) (types.FleetCatalog, error) {
+	if len(combined.sources) == 0 {
+		return nil, fmt.Errorf("no catalog sources configured")
+	}
+
+	result := types.FleetCatalog{}
+	// addresses are claimed by the source with the highest priority, by the source index, as multiple sources
+	// may have the same name
+	claimedBy := map[string]int{}
+	for idx, source := range combined.sources {
+		catalog, err := source.Catalog(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get catalog from the %s source: %w", source.Name(), err)
+		}
+
+		added := 0
+		for _, item := range sortedItems(catalog) {
+			// items without address never match any host, they are kept to not hide them from the validation
+			if owner, claimed := claimedBy[item.Address]; claimed && item.Address != "" && owner != idx {
+				log.Printf("Ignoring %s (%s) from the %s source, the address is already discovered by the %s source", item.Node, item.Address, source.Name(), combined.sources[owner].Name())
+				continue
+			}
+
+			claimedBy[item.Address] = idx
+			result.Add(item)
+			added++
+		}
+
+		log.Printf("Discovered %d fleet items from the %s source", added, source.Name())
+	}
+
+	return result, nil
+}
+
+// sortedItems returns items of all types in the stable order, so the merge result does not depend on the map order
+func sortedItems(catalog types.FleetCatalog) []types.FleetItem {
+	fleetTypes := make([]types.FleetType, 0, len(catalog))
+	for fleetType := range catalog {
+		fleetTypes = append(fleetTypes, fleetType)
+	}
+	slices.Sort(fleetTypes)
+
+	result := []types.FleetItem{}
+	for _, fleetType := range fleetTypes {
+		result = append(result, catalog[fleetType]...)
+	}
+
+	return result
+}
@@ -0,0 +1,91 @@
+package discovery_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/daniel1302/fw-manager/discovery"
+	"github.com/daniel1302/fw-manager/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticSource struct {
+	name    string
+	catalog types.FleetCatalog
+	err     error
+}
+
+func (source staticSource) Name() string {
+	return source.name
+}
+
+func (source staticSource) Catalog(_ context.Context) (types.FleetCatalog, error) {
+	return source.catalog, source.err
+}
+
+func TestCombinedSource(t *testing.T) {
+	consulSource := staticSource{name: "consul", catalog: types.FleetCatalog{
+		types.FleetMetrics: {
+			{Type: types.FleetMetrics, Node: "node-01.eu-dc1.metrics.prod", Address: "10.10.0.17"},
+		},
+		types.FleetLogs: {
+			{Type: types.FleetLogs, Node: "node-02.eu-dc1.logs.prod", Address: "10.10.0.18"},
+		},
+	}}
+	inventorySource := staticSource{name: "inventory", catalog: types.FleetCatalog{
+		types.FleetApp: {
+			// registered in consul already, consul has the priority
+			{Type: types.FleetApp, Node: "node-01", Address: "10.10.0.17"},
+			{Type: types.FleetApp, Node: "node-03.eu-dc1.app.prod", Address: "10.10.0.19"},
+		},
+	}}
+
+	t.Run("Sources are merged in the priority order", func(t *testing.T) {
+		catalog, err := discovery.NewCombinedSource(consulSource, inventorySource).Catalog(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, types.FleetCatalog{
+			types.FleetMetrics: {
+				{Type: types.FleetMetrics, Node: "node-01.eu-dc1.metrics.prod", Address: "10.10.0.17"},
+			},
+			types.FleetLogs: {
+				{Type: types.FleetLogs, Node: "node-02.eu-dc1.logs.prod", Address: "10.10.0.18"},
+			},
+			types.FleetApp: {
+				{Type: types.FleetApp, Node: "node-03.eu-dc1.app.prod", Address: "10.10.0.19"},
+			},
+		}, catalog)
+
+		catalog, err = discovery.NewCombinedSource(inventorySource, consulSource).Catalog(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "node-01", catalog.FindItemByIP([]byte{10, 10, 0, 17}).Node)
+	})
+
+	t.Run("Sources with the same name", func(t *testing.T) {
+		// e.g: two inventory files
+		primary := staticSource{name: "inventory", catalog: types.FleetCatalog{
+			types.FleetApp: {{Type: types.FleetApp, Node: "node-01", Address: "10.10.0.17"}},
+		}}
+		secondary := staticSource{name: "inventory", catalog: types.FleetCatalog{
+			types.FleetMetrics: {{Type: types.FleetMetrics, Node: "node-01.eu-dc1.metrics.prod", Address: "10.10.0.17"}},
+		}}
+
+		catalog, err := discovery.NewCombinedSource(primary, secondary).Catalog(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, types.FleetCatalog{
+			types.FleetApp: {{Type: types.FleetApp, Node: "node-01", Address: "10.10.0.17"}},
+		}, catalog)
+	})
+
+	t.Run("Failed source fails the catalog", func(t *testing.T) {
+		failing := staticSource{name: "dns", err: fmt.Errorf("no such host")}
+		_, err := discovery.NewCombinedSource(consulSource, failing).Catalog(context.Background())
+		assert.ErrorContains(t, err, "failed to get catalog from the dns source: no such host")
+	})
+
+	t.Run("No sources", func(t *testing.T) {
+		_, err := discovery.NewCombinedSource().Catalog(context.Background())
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,173 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/daniel1302/fw-manager/consul"
+)
+
+const (
+	catalogDir = "catalog"
+	// datacentersFileName is the list of the last-known datacenters, names starting with the dot are never
+	// used by the datacenter files
+	datacentersFileName = ".datacenters.json"
+	// catalogCacheVersion changes with every incompatible change of the cached catalog format
+	catalogCacheVersion = 1
+)
+
+// cachedCatalog is the file format of the cached catalog. Checksum is the sha256 of the Catalog,
+// so a truncated or modified file is never used as the fleet catalog.
+type cachedCatalog struct {
+	Version  int
+	Checksum string
+	Catalog  json.RawMessage
+}
+
+// CatalogStore keeps the last catalog fetched from every datacenter in the state directory, one file per datacenter
+type CatalogStore struct {
+	dir string
+}
+
+func NewCatalogStore(stateDir string) *CatalogStore {
+	return &CatalogStore{
+		dir: filepath.Join(stateDir, catalogDir),
+	}
+}
+
+func (store *CatalogStore) Load(datacenter string) (*consul.DatacenterCatalog, error) {
+	path, err := store.path(datacenter)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, consul.ErrNoCachedCatalog
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached catalog of %s DC: %w", datacenter, err)
+	}
+
+	cached := cachedCatalog{}
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cached catalog of %s DC: %w", datacenter, err)
+	}
+	if cached.Version != catalogCacheVersion {
+		return nil, fmt.Errorf("cached catalog of %s DC has version %d, expected %d", datacenter, cached.Version, catalogCacheVersion)
+	}
+	if checksum := catalogChecksum(cached.Catalog); checksum != cached.Checksum {
+		return nil, fmt.Errorf("cached catalog of %s DC is corrupted, checksum %s does not match %s", datacenter, checksum, cached.Checksum)
+	}
+
+	catalog := &consul.DatacenterCatalog{}
+	if err := json.Unmarshal(cached.Catalog, catalog); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cached catalog of %s DC: %w", datacenter, err)
+	}
+
+	return catalog, nil
+}
+
+// Datacenters returns the datacenters from the last successful fetch, empty when they were never saved
+func (store *CatalogStore) Datacenters() ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(store.dir, datacentersFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached datacenters: %w", err)
+	}
+
+	result := []string{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cached datacenters: %w", err)
+	}
+
+	return result, nil
+}
+
+// SaveDatacenters stores the datacenters and removes the cached catalog of datacenters not on the list,
+// so the cache does not grow with every datacenter ever seen
+func (store *CatalogStore) SaveDatacenters(datacenters []string) error {
+	if err := os.MkdirAll(store.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create catalog cache directory: %w", err)
+	}
+
+	data, err := json.Marshal(datacenters)
+	if err != nil {
+		return fmt.Errorf("failed to marshal datacenters: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(store.dir, datacentersFileName), data); err != nil {
+		return fmt.Errorf("failed to write datacenters: %w", err)
+	}
+
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list catalog cache directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if slices.Contains(datacenters, strings.TrimSuffix(name, ".json")) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(store.dir, name)); err != nil {
+			return fmt.Errorf("failed to remove cached catalog of %s DC: %w", strings.TrimSuffix(name, ".json"), err)
+		}
+	}
+
+	return nil
+}
+
+func (store *CatalogStore) Save(catalog consul.DatacenterCatalog) error {
+	path, err := store.path(catalog.Datacenter)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(store.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create catalog cache directory: %w", err)
+	}
+
+	catalogData, err := json.Marshal(catalog)
+	if err != nil {
+		return fmt.Errorf("failed to marshal catalog of %s DC: %w", catalog.Datacenter, err)
+	}
+
+	data, err := json.Marshal(cachedCatalog{
+		Version:  catalogCacheVersion,
+		Checksum: catalogChecksum(catalogData),
+		Catalog:  catalogData,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal catalog of %s DC: %w", catalog.Datacenter, err)
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write catalog of %s DC: %w", catalog.Datacenter, err)
+	}
+
+	return nil
+}
+
+func catalogChecksum(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+func (store *CatalogStore) path(datacenter string) (string, error) {
+	if datacenter == "" || strings.ContainsAny(datacenter, `/\`) || strings.HasPrefix(datacenter, ".") {
+		return "", fmt.Errorf("invalid datacenter name %q", datacenter)
+	}
+
+	return filepath.Join(store.dir, datacenter+".json"), nil
+}
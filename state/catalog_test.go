@@ -0,0 +1,64 @@
+package state_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daniel1302/fw-manager/consul"
+	"github.com/daniel1302/fw-manager/state"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalogStore(t *testing.T) {
+	stateDir := t.TempDir()
+	store := state.NewCatalogStore(stateDir)
+
+	_, err := store.Load("asia-dc")
+	assert.ErrorIs(t, err, consul.ErrNoCachedCatalog)
+
+	catalog := consul.DatacenterCatalog{
+		Datacenter: "asia-dc",
+		FetchedAt:  time.Date(2024, 9, 16, 10, 0, 0, 0, time.UTC),
+		Services:   []*consulapi.CatalogService{{Node: "node-01.asia-dc", ServiceAddress: "10.10.0.17"}},
+	}
+	assert.NoError(t, store.Save(catalog))
+
+	loaded, err := store.Load("asia-dc")
+	assert.NoError(t, err)
+	assert.Equal(t, &catalog, loaded)
+
+	// datacenters are unknown until they are saved
+	datacenters, err := store.Datacenters()
+	assert.NoError(t, err)
+	assert.Empty(t, datacenters)
+
+	assert.NoError(t, store.Save(consul.DatacenterCatalog{Datacenter: "old-dc"}))
+	assert.NoError(t, store.SaveDatacenters([]string{"asia-dc", "eu-dc"}))
+
+	datacenters, err = store.Datacenters()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"asia-dc", "eu-dc"}, datacenters)
+
+	// catalog of the datacenter not on the list is removed
+	_, err = store.Load("old-dc")
+	assert.ErrorIs(t, err, consul.ErrNoCachedCatalog)
+	_, err = store.Load("asia-dc")
+	assert.NoError(t, err)
+
+	assert.Error(t, store.Save(consul.DatacenterCatalog{Datacenter: "../asia-dc"}))
+
+	t.Run("Corrupted cache is not used", func(t *testing.T) {
+		path := filepath.Join(stateDir, "catalog", "asia-dc.json")
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, bytes.Replace(data, []byte("10.10.0.17"), []byte("10.10.0.99"), 1), 0o600))
+
+		_, err = store.Load("asia-dc")
+		assert.ErrorContains(t, err, "checksum")
+	})
+}
@@ -0,0 +1,44 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic calls write with the temporary file and moves the file to the destination,
+// so the file is never left half written.
+func WriteFileAtomic(filePath string, write func(w io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return fmt.Errorf("failed to move temporary file to %s: %w", filePath, err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data with the WriteFileAtomic
+func writeFileAtomic(filePath string, data []byte) error {
+	return WriteFileAtomic(filePath, func(w io.Writer) error {
+		if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("failed to write temporary file: %w", err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,44 @@
+package state_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/daniel1302/fw-manager/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.txt")
+
+	err := state.WriteFileAtomic(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, "COMMIT\n")
+		return err
+	})
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "COMMIT\n", string(data))
+
+	t.Run("Failed write keeps the existing file", func(t *testing.T) {
+		err := state.WriteFileAtomic(path, func(w io.Writer) error {
+			io.WriteString(w, "*filter\n")
+			return fmt.Errorf("write failed")
+		})
+		assert.ErrorContains(t, err, "write failed")
+
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "COMMIT\n", string(data))
+
+		// temporary file is removed
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+}
@@ -0,0 +1,69 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const healthFileName = "health.json"
+
+// HealthStore keeps fleet instances seen healthy and when they were seen unhealthy for the first time, so the
+// health grace period spans separate runs
+type HealthStore struct {
+	path string
+}
+
+// HealthState is the health of fleet instances seen by previous runs, by the instance key
+type HealthState struct {
+	Healthy        map[string]bool
+	UnhealthySince map[string]time.Time
+}
+
+func NewHealthStore(stateDir string) *HealthStore {
+	return &HealthStore{
+		path: filepath.Join(stateDir, healthFileName),
+	}
+}
+
+// Load returns the health of instances seen by previous runs
+func (store *HealthStore) Load() (HealthState, error) {
+	result := HealthState{
+		Healthy:        map[string]bool{},
+		UnhealthySince: map[string]time.Time{},
+	}
+
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return result, nil
+	}
+	if err != nil {
+		return HealthState{}, fmt.Errorf("failed to read health state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return HealthState{}, fmt.Errorf("failed to unmarshal health state: %w", err)
+	}
+
+	return result, nil
+}
+
+func (store *HealthStore) Save(health HealthState) error {
+	if err := os.MkdirAll(filepath.Dir(store.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(health, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal health state: %w", err)
+	}
+
+	if err := writeFileAtomic(store.path, data); err != nil {
+		return fmt.Errorf("failed to write health state: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package state_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daniel1302/fw-manager/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthStore(t *testing.T) {
+	store := state.NewHealthStore(t.TempDir())
+
+	health, err := store.Load()
+	assert.NoError(t, err)
+	assert.Empty(t, health.Healthy)
+	assert.Empty(t, health.UnhealthySince)
+
+	since := time.Date(2024, 9, 16, 10, 0, 0, 0, time.UTC)
+	saved := state.HealthState{
+		Healthy:        map[string]bool{"dc1/node-01/wireguard": true, "dc1/node-02/wireguard": true},
+		UnhealthySince: map[string]time.Time{"dc1/node-01/wireguard": since},
+	}
+	assert.NoError(t, store.Save(saved))
+
+	health, err = store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, saved, health)
+}
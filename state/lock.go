@@ -0,0 +1,92 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	lockFileName      = "fw-manager.lock"
+	lockRetryInterval = 100 * time.Millisecond
+)
+
+var ErrLocked error = fmt.Errorf("another fw-manager run holds the lock")
+
+// Lock is the exclusive lock held for the whole run, so concurrent runs never interleave changes of the ruleset
+type Lock struct {
+	file *os.File
+}
+
+// AcquireLock takes the exclusive lock on the file in the state directory. When another run holds the lock,
+// it waits up to the timeout for the lock to be released.
+func AcquireLock(stateDir string, timeout time.Duration) (*Lock, error) {
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	lockPath := filepath.Join(stateDir, lockFileName)
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", lockPath, err)
+		}
+		if time.Now().After(deadline) {
+			holder := lockHolder(file)
+			file.Close()
+			return nil, fmt.Errorf("%w: %s is locked by the process with PID %s, waited %s", ErrLocked, lockPath, holder, timeout)
+		}
+
+		time.Sleep(lockRetryInterval)
+	}
+
+	// The PID is only informative, the lock is held by the flock
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// Release unlocks the lock file. The file is not removed, removing it would let the next run lock a new file
+// while the waiting run locks the removed one. Releasing the nil lock does nothing.
+func (lock *Lock) Release() error {
+	if lock == nil {
+		return nil
+	}
+	defer lock.file.Close()
+
+	if err := syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN); err != nil {
+		return fmt.Errorf("failed to unlock %s: %w", lock.file.Name(), err)
+	}
+
+	return nil
+}
+
+// lockHolder returns the PID written to the lock file by the run holding the lock
+func lockHolder(file *os.File) string {
+	data := make([]byte, 32)
+	n, _ := file.ReadAt(data, 0)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data[:n])))
+	if err != nil {
+		return "unknown"
+	}
+
+	return strconv.Itoa(pid)
+}
@@ -0,0 +1,36 @@
+package state_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/daniel1302/fw-manager/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireLock(t *testing.T) {
+	stateDir := t.TempDir()
+
+	lock, err := state.AcquireLock(stateDir, 0)
+	assert.NoError(t, err)
+
+	_, err = state.AcquireLock(stateDir, 200*time.Millisecond)
+	assert.True(t, errors.Is(err, state.ErrLocked))
+	assert.Contains(t, err.Error(), fmt.Sprintf("PID %d", os.Getpid()))
+
+	// The waiting run gets the lock when the holder releases it
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		lock.Release()
+	}()
+
+	waiting, err := state.AcquireLock(stateDir, 5*time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, waiting.Release())
+
+	var disabled *state.Lock
+	assert.NoError(t, disabled.Release())
+}
@@ -0,0 +1,155 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/daniel1302/fw-manager/system"
+)
+
+const (
+	DefaultStateDir = "/var/lib/fw-manager"
+
+	snapshotsDir      = "snapshots"
+	snapshotExtension = ".json"
+	runIDFormat       = "20060102T150405.000000Z"
+)
+
+var ErrNoSnapshots error = fmt.Errorf("no snapshots found")
+
+// Snapshot keeps the ruleset from before the change and the change computed in the run
+type Snapshot struct {
+	RunID     string
+	CreatedAt time.Time
+	// Ruleset is the whole ruleset of all tables in the `iptables-save` format before the change
+	Ruleset string
+	// Rules are the INPUT chain rules in the `iptables -S` format before the change, the rollback restores
+	// managed rules from them
+	Rules []string
+	// IPSetMode is true when the run managed peers with ipsets, Sets are then members of managed sets before the change
+	IPSetMode bool
+	Sets      []system.IPSet
+	Plan      SnapshotPlan
+}
+
+type SnapshotPlan struct {
+	system.Plan
+	IPSets *system.IPSetExecutionPlan `json:",omitempty"`
+}
+
+// SnapshotStore keeps the last snapshots in the state directory, one file per run
+type SnapshotStore struct {
+	dir  string
+	keep int
+}
+
+func NewSnapshotStore(stateDir string, keep int) *SnapshotStore {
+	return &SnapshotStore{
+		dir:  filepath.Join(stateDir, snapshotsDir),
+		keep: keep,
+	}
+}
+
+// NewRunID returns the identifier of the run, identifiers are sorted in the order of runs
+func NewRunID(now time.Time) string {
+	return now.UTC().Format(runIDFormat)
+}
+
+// Save writes snapshot and removes the oldest snapshots over the limit
+func (store *SnapshotStore) Save(snapshot Snapshot) error {
+	if snapshot.RunID == "" {
+		return fmt.Errorf("missing run id in the snapshot")
+	}
+
+	if err := os.MkdirAll(store.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create snapshots directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	if err := writeFileAtomic(store.path(snapshot.RunID), data); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	return store.prune()
+}
+
+// List returns identifiers of all stored runs, the newest first
+func (store *SnapshotStore) List() ([]string, error) {
+	entries, err := os.ReadDir(store.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots directory: %w", err)
+	}
+
+	result := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), snapshotExtension) {
+			continue
+		}
+		result = append(result, strings.TrimSuffix(entry.Name(), snapshotExtension))
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(result)))
+
+	return result, nil
+}
+
+// Load reads the snapshot of given run, empty run id means the latest run
+func (store *SnapshotStore) Load(runID string) (*Snapshot, error) {
+	if runID == "" {
+		runs, err := store.List()
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) == 0 {
+			return nil, ErrNoSnapshots
+		}
+		runID = runs[0]
+	}
+
+	if strings.ContainsAny(runID, `/\`) {
+		return nil, fmt.Errorf("invalid run id %q", runID)
+	}
+
+	data, err := os.ReadFile(store.path(runID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot of the %s run: %w", runID, err)
+	}
+
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot of the %s run: %w", runID, err)
+	}
+
+	return snapshot, nil
+}
+
+func (store *SnapshotStore) prune() error {
+	runs, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	for idx := store.keep; idx < len(runs); idx++ {
+		if err := os.Remove(store.path(runs[idx])); err != nil {
+			return fmt.Errorf("failed to remove old snapshot of the %s run: %w", runs[idx], err)
+		}
+	}
+
+	return nil
+}
+
+func (store *SnapshotStore) path(runID string) string {
+	return filepath.Join(store.dir, runID+snapshotExtension)
+}
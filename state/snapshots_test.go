@@ -0,0 +1,66 @@
+package state_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daniel1302/fw-manager/state"
+	"github.com/daniel1302/fw-manager/system"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	store := state.NewSnapshotStore(t.TempDir(), 3)
+
+	t.Run("Load from empty store", func(t *testing.T) {
+		_, err := store.Load("")
+		assert.ErrorIs(t, err, state.ErrNoSnapshots)
+	})
+
+	start := time.Date(2024, 9, 16, 10, 0, 0, 0, time.UTC)
+	for idx := 0; idx < 5; idx++ {
+		err := store.Save(state.Snapshot{
+			RunID:     state.NewRunID(start.Add(time.Duration(idx) * time.Minute)),
+			CreatedAt: start.Add(time.Duration(idx) * time.Minute),
+			Ruleset:   "*filter\n:INPUT ACCEPT [0:0]\nCOMMIT\n",
+			Rules:     []string{"-P INPUT ACCEPT"},
+			Plan: state.SnapshotPlan{
+				Plan: system.Plan{
+					Add: []system.FirewallRule{{IP: "10.10.0.17", Port: system.NodeExporterPort}},
+				},
+			},
+		})
+		assert.NoError(t, err)
+	}
+
+	t.Run("Keep only the last runs", func(t *testing.T) {
+		runs, err := store.List()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"20240916T100400.000000Z",
+			"20240916T100300.000000Z",
+			"20240916T100200.000000Z",
+		}, runs)
+	})
+
+	t.Run("Load the latest run", func(t *testing.T) {
+		snapshot, err := store.Load("")
+		assert.NoError(t, err)
+		assert.Equal(t, "20240916T100400.000000Z", snapshot.RunID)
+		assert.Equal(t, "*filter\n:INPUT ACCEPT [0:0]\nCOMMIT\n", snapshot.Ruleset)
+		assert.Equal(t, []string{"-P INPUT ACCEPT"}, snapshot.Rules)
+		assert.Equal(t, []system.FirewallRule{{IP: "10.10.0.17", Port: system.NodeExporterPort}}, snapshot.Plan.Add)
+	})
+
+	t.Run("Load given run", func(t *testing.T) {
+		snapshot, err := store.Load("20240916T100200.000000Z")
+		assert.NoError(t, err)
+		assert.Equal(t, "20240916T100200.000000Z", snapshot.RunID)
+
+		_, err = store.Load("20240916T100000.000000Z")
+		assert.Error(t, err)
+
+		_, err = store.Load("../../etc/passwd")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,37 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const statusFileName = "status.json"
+
+// RunStatus describes the last applied run, e.g: for monitoring
+type RunStatus struct {
+	RunAt time.Time
+	// CatalogCached is true when the fleet catalog, or any of its datacenters, came from the cache instead of consul
+	CatalogCached     bool
+	CachedDatacenters []string `json:",omitempty"`
+}
+
+// SaveRunStatus writes status of the run to the state directory, it replaces status of the previous run
+func SaveRunStatus(stateDir string, status RunStatus) error {
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal run status: %w", err)
+	}
+
+	if err := writeFileAtomic(filepath.Join(stateDir, statusFileName), data); err != nil {
+		return fmt.Errorf("failed to write run status: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package state_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daniel1302/fw-manager/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveRunStatus(t *testing.T) {
+	stateDir := t.TempDir()
+	status := state.RunStatus{
+		RunAt:             time.Date(2024, 9, 16, 10, 0, 0, 0, time.UTC),
+		CatalogCached:     true,
+		CachedDatacenters: []string{"asia-dc"},
+	}
+	require.NoError(t, state.SaveRunStatus(stateDir, status))
+
+	data, err := os.ReadFile(filepath.Join(stateDir, "status.json"))
+	require.NoError(t, err)
+
+	saved := state.RunStatus{}
+	require.NoError(t, json.Unmarshal(data, &saved))
+	assert.Equal(t, status, saved)
+}
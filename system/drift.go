@@ -0,0 +1,89 @@
+package system
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DriftEvent describes a managed rule which was modified outside of the fw-manager
+type DriftEvent struct {
+	Rule        FirewallRule
+	Differences []string
+}
+
+func (e DriftEvent) String() string {
+	return fmt.Sprintf("rule for port %d and source %s drifted: %s", e.Rule.Port, e.Rule.IP, strings.Join(e.Differences, ", "))
+}
+
+// DriftEvents returns event for every drifted rule
+func DriftEvents(rules []FirewallRule) []DriftEvent {
+	result := []DriftEvent{}
+	for _, rule := range rules {
+		if rule.Drifted() {
+			result = append(result, DriftEvent{
+				Rule:        rule,
+				Differences: rule.Drift,
+			})
+		}
+	}
+
+	return result
+}
+
+// managedRuleDrift compares the managed rule with the rule fw-manager creates in the ExecuteRules
+// and returns all differences. Nil result means rule was not modified.
+func managedRuleDrift(rule *iptablesRule) []string {
+	var differences []string
+	expect := func(field, actual, expected string) {
+		if actual != expected {
+			differences = append(differences, fmt.Sprintf("%s is %q, expected %q", field, actual, expected))
+		}
+	}
+	unexpected := func(field, actual string) {
+		if actual != "" {
+			differences = append(differences, fmt.Sprintf("unexpected %s %q", field, actual))
+		}
+	}
+
+	expect("chain", rule.chain, IptablesChainInput)
+	expect("target", rule.target, "ACCEPT")
+	expect("protocol", rule.proto, "tcp")
+
+	if rule.source == "" {
+		differences = append(differences, "missing source")
+	} else if strings.Contains(rule.source, "/") && !strings.HasSuffix(rule.source, "/32") {
+		differences = append(differences, fmt.Sprintf("source %q is not a single host", rule.source))
+	}
+
+	if _, single := rule.singleDstPort(); !single {
+		ports := []string{}
+		for _, port := range rule.dstPorts {
+			ports = append(ports, port.String())
+		}
+		differences = append(differences, fmt.Sprintf("destination port %q is not a single port", strings.Join(ports, ",")))
+	}
+
+	// in interface is compared with the desired rule in the PrepareRulesExecutionPlan, see interfaceDrift
+	unexpected("destination", rule.destination)
+	unexpected("out interface", rule.outInterface)
+	if len(rule.srcPorts) > 0 {
+		differences = append(differences, "unexpected source port")
+	}
+
+	for _, field := range rule.negated {
+		differences = append(differences, fmt.Sprintf("unexpected negation of %s", field))
+	}
+
+	for _, match := range rule.matches {
+		if !slices.Contains([]string{"tcp", "comment"}, match) {
+			differences = append(differences, fmt.Sprintf("unexpected match %q", match))
+		}
+	}
+
+	if len(rule.unknown) > 0 {
+		differences = append(differences, fmt.Sprintf("unexpected options %q", strings.Join(rule.unknown, " ")))
+	}
+
+	return differences
+}
@@ -0,0 +1,127 @@
+package system
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagedRuleDrift(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rule     string
+		expected []string
+	}{
+		{
+			name: "Rule created by fw-manager",
+			rule: `-A INPUT -s 10.10.0.18/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`,
+		},
+		{
+			name:     "Target changed",
+			rule:     `-A INPUT -s 10.10.0.18/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j DROP`,
+			expected: []string{`target is "DROP", expected "ACCEPT"`},
+		},
+		{
+			name: "Rule bound to the interface by fw-manager",
+			rule: `-A INPUT -s 10.10.0.18/32 -i wg0 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`,
+		},
+		{
+			name:     "Out interface added",
+			rule:     `-A INPUT -s 10.10.0.18/32 -o eth0 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`,
+			expected: []string{`unexpected out interface "eth0"`},
+		},
+		{
+			name:     "Interface negated",
+			rule:     `-A INPUT -s 10.10.0.18/32 ! -i wg0 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`,
+			expected: []string{"unexpected negation of inInterface"},
+		},
+		{
+			name: "Protocol changed",
+			rule: `-A INPUT -s 10.10.0.18/32 -p udp -m udp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`,
+			expected: []string{
+				`protocol is "udp", expected "tcp"`,
+				`unexpected match "udp"`,
+			},
+		},
+		{
+			name: "Source widened and negated",
+			rule: `-A INPUT ! -s 10.10.0.0/16 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`,
+			expected: []string{
+				`source "10.10.0.0/16" is not a single host`,
+				"unexpected negation of source",
+			},
+		},
+		{
+			name:     "Extra match",
+			rule:     `-A INPUT -s 10.10.0.18/32 -p tcp -m tcp --dport 9100 -m conntrack --ctstate NEW -m comment --comment "FW-MANAGER RULE" -j ACCEPT`,
+			expected: []string{`unexpected match "conntrack"`, `unexpected options "--ctstate NEW"`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, err := parseRule(tc.rule)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, managedRuleDrift(rule))
+		})
+	}
+}
+
+func TestPrepareRulesExecutionPlanReplacesDrift(t *testing.T) {
+	drifted := FirewallRule{IP: "10.10.0.18", Port: NodeExporterPort, RawRule: "-A INPUT ... -j DROP", Drift: []string{"target"}}
+	existing := []FirewallRule{
+		{IP: "10.10.0.17", Port: NodeExporterPort},
+		drifted,
+	}
+	desired := []FirewallRule{
+		{IP: "10.10.0.17", Port: NodeExporterPort},
+		{IP: "10.10.0.18", Port: NodeExporterPort},
+	}
+
+	plan := PrepareRulesExecutionPlan(existing, desired)
+	assert.Equal(t, []FirewallRule{drifted}, plan.Delete)
+	assert.Equal(t, []FirewallRule{drifted}, plan.Drifted)
+	assert.Equal(t, []FirewallRule{{IP: "10.10.0.18", Port: NodeExporterPort}}, plan.Add)
+
+	assert.Equal(t, []DriftEvent{{Rule: drifted, Differences: []string{"target"}}}, DriftEvents(existing))
+}
+
+func TestPrepareRulesExecutionPlanComparesInterface(t *testing.T) {
+	existing := []FirewallRule{
+		{IP: "10.10.0.17", Port: NodeExporterPort, Interface: "wg0"},
+		{IP: "10.10.0.18", Port: NodeExporterPort, Interface: "eth0"},
+		{IP: "10.10.0.19", Port: NodeExporterPort},
+	}
+	desired := BindRulesToInterface([]FirewallRule{
+		{IP: "10.10.0.17", Port: NodeExporterPort},
+		{IP: "10.10.0.18", Port: NodeExporterPort},
+		{IP: "10.10.0.19", Port: NodeExporterPort},
+	}, "wg0")
+
+	plan := PrepareRulesExecutionPlan(existing, desired)
+	assert.Equal(t, []RuleKey{existing[1].Key(), existing[2].Key()}, []RuleKey{plan.Delete[0].Key(), plan.Delete[1].Key()})
+	assert.Equal(t, desired[1:], plan.Add)
+	assert.Equal(t, []string{
+		"-s", "10.10.0.18/32", "-i", "wg0", "-p", "tcp", "-m", "tcp", "--dport", "9100",
+		"-m", "comment", "--comment", ManagedComment, "-j", "ACCEPT",
+	}, ruleSpec(plan.Add[0]))
+	assert.Equal(t, 2, plan.Stats.Drifted)
+	assert.Equal(t, []DriftEvent{
+		{Rule: plan.Drifted[0], Differences: []string{`in interface is "eth0", expected "wg0"`}},
+		{Rule: plan.Drifted[1], Differences: []string{`in interface is "", expected "wg0"`}},
+	}, DriftEvents(plan.Drifted))
+
+	t.Run("Interface added", func(t *testing.T) {
+		fake := &fakeIPTables{rules: []string{
+			`-A INPUT -s 10.10.0.18/32 -i eth0 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`,
+		}}
+		existing, err := (&FirewallManager{wrapper: fake}).ListManagedFirewallRules()
+		assert.NoError(t, err)
+
+		plan := PrepareRulesExecutionPlan(existing, []FirewallRule{{IP: "10.10.0.18", Port: NodeExporterPort}})
+		assert.Equal(t, 1, plan.Stats.Drifted)
+		assert.Equal(t, []string{`in interface is "eth0", expected ""`}, plan.Drifted[0].Drift)
+		// the rule from the iptables is not modified
+		assert.Empty(t, existing[0].Drift)
+	})
+}
@@ -2,8 +2,6 @@ package system
 
 import (
 	"fmt"
-	"slices"
-	"strconv"
 	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
@@ -16,17 +14,19 @@ const (
 	ManagedComment = "FW-MANAGER RULE"
 )
 
-type FirewallManager struct {
-	wrapper *iptables.IPTables
+// iptablesWrapper is the subset of the iptables.IPTables used by the FirewallManager
+type iptablesWrapper interface {
+	List(table, chain string) ([]string, error)
+	Delete(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	AppendUnique(table, chain string, rulespec ...string) error
+	Insert(table, chain string, pos int, rulespec ...string) error
 }
 
-type iptablesRule struct {
-	chain   string
-	proto   string
-	source  string
-	dstPort int
-	comment string
-	target  string
+type FirewallManager struct {
+	wrapper   iptablesWrapper
+	placement RulePlacement
 }
 
 func NewFirewallManager(wrapper *iptables.IPTables) (*FirewallManager, error) {
@@ -43,174 +43,175 @@ func NewFirewallManager(wrapper *iptables.IPTables) (*FirewallManager, error) {
 	}, nil
 }
 
+// NewOfflineFirewallManager creates manager operating on the ruleset read from the iptables-save output
+// instead of the host iptables. Applied rules are visible in the ruleset.
+func NewOfflineFirewallManager(ruleset *IptablesSave) *FirewallManager {
+	return &FirewallManager{
+		wrapper: ruleset,
+	}
+}
+
+// SetPlacement changes where the managed rules are located in the chain, rules are appended by default.
+func (fwm *FirewallManager) SetPlacement(placement RulePlacement) {
+	fwm.placement = placement
+}
+
 func (fwm *FirewallManager) ListManagedFirewallRules() ([]FirewallRule, error) {
-	rawRules, err := fwm.wrapper.List(IptablesTableFilter, IptablesChainInput)
+	rules, err := listChainRules(fwm.wrapper)
+	if err != nil {
+		return nil, err
+	}
+
+	lower, upper, err := fwm.placement.bounds(rules)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list all iptables rules: %w", err)
+		return nil, fmt.Errorf("failed to check placement of managed rules: %w", err)
 	}
 
 	result := []FirewallRule{}
-	for _, rawRule := range rawRules {
-		rule, err := parseRule(rawRule)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse rule(%s): %w", rawRule, err)
+	for idx, chainRule := range rules {
+		rule := chainRule.parsed
+		if rule == nil {
+			// Rules not created by fw-manager are irrelevant, we must not fail the run because of them
+			if !strings.Contains(chainRule.raw, ManagedComment) {
+				continue
+			}
+			_, err := parseRule(chainRule.raw)
+			return nil, fmt.Errorf("failed to parse rule(%s): %w", chainRule.raw, err)
+		}
+
+		if rule.comment != ManagedComment {
+			continue
 		}
 
-		if rule.comment == ManagedComment {
-			result = append(result, FirewallRule{
-				IP:   RuleIP(rule.source),
-				Port: RulePort(rule.dstPort),
-			})
+		drift := managedRuleDrift(rule)
+		if misplacement := fwm.placement.misplacement(idx, lower, upper); misplacement != "" {
+			drift = append(drift, misplacement)
 		}
+
+		// Port is 0 when the managed rule was modified to match something else than a single port.
+		// Drifted rules are deleted with their raw form and created again.
+		port, _ := rule.singleDstPort()
+		result = append(result, FirewallRule{
+			IP:        RuleIP(strings.TrimSuffix(rule.source, "/32")),
+			Port:      RulePort(port),
+			Interface: rule.inInterface,
+			RawRule:   chainRule.raw,
+			Drift:     drift,
+		})
 	}
 
 	return result, nil
 }
 
-func (fwm *FirewallManager) ExecuteRules(add []FirewallRule, delete []FirewallRule) error {
-	// sudo iptables -D INPUT -p tcp -m tcp --dport 80 -m comment --comment "FW-MANAGER RULE" -j ACCEPT
-	for _, rule := range delete {
-		err := fwm.wrapper.Delete(
-			IptablesTableFilter,
-			IptablesChainInput,
-			"-p", "tcp",
-			"-m", "tcp",
-			"--dport", fmt.Sprintf("%d", rule.Port),
-			"-s", string(rule.IP),
-			"-m", "comment", "--comment", ManagedComment,
-			"-j", "ACCEPT",
-		)
+// ExecuteRules deletes and then adds rules of the plan. Every applied operation is recorded in the journal.
+// When any operation fails, the journal is undone in the reverse order and the *ApplyError is returned.
+func (fwm *FirewallManager) ExecuteRules(plan Plan) error {
+	journal := &ruleJournal{}
 
+	// the original positions let the rollback put deleted rules back exactly where they were
+	var positions *rulePositions
+	if len(plan.Delete) > 0 {
+		var err error
+		positions, err = listRulePositions(fwm.wrapper)
 		if err != nil {
-			return fmt.Errorf("failed to delete rule with port %d and user %s: %w", rule.Port, rule.IP, err)
+			return fwm.rollback(journal, fmt.Errorf("failed to find positions of rules to delete: %w", err))
 		}
 	}
 
-	// sudo iptables -A INPUT -p tcp -m tcp --dport 80 -m comment --comment "FW-MANAGER RULE" -j ACCEPT
-	for _, rule := range add {
-		err := fwm.wrapper.AppendUnique(
-			IptablesTableFilter,
-			IptablesChainInput,
-			"-p", "tcp",
-			"-m", "tcp",
-			"--dport", fmt.Sprintf("%d", rule.Port),
-			"-s", string(rule.IP),
-			"-m", "comment", "--comment", ManagedComment,
-			"-j", "ACCEPT",
-		)
-		if err != nil {
-			return fmt.Errorf("failed to add rule with port %d and user %s: %w", rule.Port, rule.IP, err)
+	// sudo iptables -D INPUT -s 10.10.0.17/32 -i wg0 -p tcp -m tcp --dport 80 -m comment --comment "FW-MANAGER RULE" -j ACCEPT
+	for _, rule := range plan.Delete {
+		if err := fwm.deleteRule(rule); err != nil {
+			return fwm.rollback(journal, fmt.Errorf("failed to delete rule with port %d and user %s: %w", rule.Port, rule.IP, err))
 		}
+		journal.record(operationDelete, rule, positions.deleted(ruleSpec(rule)))
 	}
 
-	return nil
-}
+	if len(plan.Add) == 0 {
+		return nil
+	}
 
-// PrepareRulesExecutionPlan checks existing and new rules and determine which needs to be added and which removed
-// It returns rules to delete, rules to add and optionally error
-func PrepareRulesExecutionPlan(existingRules []FirewallRule, newRules []FirewallRule) ([]FirewallRule, []FirewallRule, error) {
-	rulesToDelete := []FirewallRule{}
-	rulesToAdd := []FirewallRule{}
-
-	// Find rules that exists in iptables but they should not be added anymore
-	for idx, rule := range existingRules {
-		if !slices.ContainsFunc(newRules, func(nR FirewallRule) bool {
-			return rule.IP == nR.IP && rule.Port == nR.Port
-		}) {
-			rulesToDelete = append(rulesToDelete, existingRules[idx])
-		}
+	position, err := placementPosition(fwm.wrapper, fwm.placement)
+	if err != nil {
+		return fwm.rollback(journal, fmt.Errorf("failed to find position for new rules: %w", err))
 	}
 
-	// Find rules that should be added but they do not exist in the iptables anymore
-	for idx, rule := range newRules {
-		if slices.ContainsFunc(existingRules, func(nR FirewallRule) bool {
-			return rule.IP == nR.IP && rule.Port == nR.Port
-		}) {
-			// rule already exists
-			continue
+	// sudo iptables -A INPUT -s 10.10.0.17/32 -i wg0 -p tcp -m tcp --dport 80 -m comment --comment "FW-MANAGER RULE" -j ACCEPT
+	// or with placement other than append:
+	// sudo iptables -I INPUT <position> -s 10.10.0.17/32 -i wg0 -p tcp -m tcp --dport 80 -m comment --comment "FW-MANAGER RULE" -j ACCEPT
+	for _, rule := range plan.Add {
+		changed, err := placeRule(fwm.wrapper, position, ruleSpec(rule))
+		if err != nil {
+			return fwm.rollback(journal, fmt.Errorf("failed to add rule with port %d and user %s: %w", rule.Port, rule.IP, err))
+		}
+		// the rule existing before the run is not undone by the rollback
+		if changed {
+			journal.record(operationAppend, rule, 0)
 		}
 
-		rulesToAdd = append(rulesToAdd, newRules[idx])
+		// next rule goes after the inserted one to keep the order of the plan
+		if position > 0 {
+			position++
+		}
 	}
 
-	return rulesToDelete, rulesToAdd, nil
+	return nil
 }
 
-type tokenT string
-
-func parseRule(rule string) (*iptablesRule, error) {
-	const (
-		tokenEmpty          tokenT = ""
-		tokenChain          tokenT = "chain"
-		tokenProto          tokenT = "proto"
-		tokenSource         tokenT = "source"
-		tokenDstPort        tokenT = "dstPort"
-		tokenComment        tokenT = "comment"
-		tokenTarget         tokenT = "target"
-		tokenCommentContent tokenT = "commentContent"
-	)
-
-	ruleSlice := strings.Split(rule, " ")
-
-	result := &iptablesRule{}
-
-	currentToken := tokenEmpty
-	for _, part := range ruleSlice {
-		switch currentToken {
-		// check if current flag is one of the potentially usefull
-		case tokenEmpty:
-			switch part {
-			default:
-				currentToken = tokenEmpty
-			case "-A", "--append":
-				currentToken = tokenChain
-			case "-p", "--protocol":
-				currentToken = tokenProto
-			case "--dport", "--destination-port":
-				currentToken = tokenDstPort
-			case "--comment":
-				currentToken = tokenComment
-			case "-j", "--jump":
-				currentToken = tokenTarget
-			case "-s", "--source":
-				currentToken = tokenSource
-			}
+func (fwm *FirewallManager) deleteRule(rule FirewallRule) error {
+	return fwm.wrapper.Delete(IptablesTableFilter, IptablesChainInput, ruleSpec(rule)...)
+}
 
-		case tokenChain:
-			result.chain = part
-			currentToken = tokenEmpty
+// restoreRule adds back the deleted rule at its original 1-based position. Rule which position is unknown
+// is placed at the position required by the placement.
+func (fwm *FirewallManager) restoreRule(rule FirewallRule, position int) error {
+	if position > 0 {
+		return fwm.wrapper.Insert(IptablesTableFilter, IptablesChainInput, position, ruleSpec(rule)...)
+	}
 
-		case tokenProto:
-			result.proto = part
-			currentToken = tokenEmpty
+	position, err := placementPosition(fwm.wrapper, fwm.placement)
+	if err != nil {
+		return err
+	}
 
-		case tokenDstPort:
-			port, err := strconv.Atoi(part)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse dst port(%s) to int: %w", part, err)
-			}
+	_, err = placeRule(fwm.wrapper, position, ruleSpec(rule))
+	return err
+}
 
-			currentToken = tokenEmpty
-			result.dstPort = port
+// ruleSpec returns arguments of the rule without the chain. Rules listed from iptables are
+// reproduced from their raw form, so they can be deleted or restored exactly as they were.
+func ruleSpec(rule FirewallRule) []string {
+	if rule.RawRule != "" {
+		if spec := rawRuleSpec(rule.RawRule); spec != nil {
+			return spec
+		}
+	}
 
-		case tokenComment:
-			result.comment = result.comment + " " + part
+	// Arguments are in the same order as in the `iptables -S` output
+	source := string(rule.IP)
+	if !strings.Contains(source, "/") {
+		source += "/32"
+	}
 
-			// keep adding comment as long as not finished
-			if strings.HasSuffix(part, "\"") {
-				result.comment = strings.Trim(result.comment, " \"")
-				currentToken = tokenEmpty
-			}
+	spec := []string{"-s", source}
+	if rule.Interface != "" {
+		spec = append(spec, "-i", rule.Interface)
+	}
 
-		case tokenTarget:
-			result.target = part
-			currentToken = tokenEmpty
+	return append(spec,
+		"-p", "tcp",
+		"-m", "tcp",
+		"--dport", fmt.Sprintf("%d", rule.Port),
+		"-m", "comment", "--comment", ManagedComment,
+		"-j", "ACCEPT",
+	)
+}
 
-		case tokenSource:
-			result.source = part
-			currentToken = tokenEmpty
-		}
+// rawRuleSpec returns arguments of the rule in the `iptables -S` format without the chain, nil when rule is invalid
+func rawRuleSpec(rawRule string) []string {
+	tokens, err := tokenizeRule(rawRule)
+	if err != nil || len(tokens) <= 2 || tokens[0] != "-A" {
+		return nil
 	}
 
-	return result, nil
+	return tokens[2:]
 }
@@ -1,55 +1,112 @@
 package system
 
 import (
+	"fmt"
+	"slices"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestParseRule(t *testing.T) {
-	t.Run("Parse tcp", func(t *testing.T) {
-		expected := &iptablesRule{
-			chain:   "INPUT",
-			proto:   "tcp",
-			dstPort: 80,
-			comment: "",
-			target:  "ACCEPT",
+func TestListManagedFirewallRules(t *testing.T) {
+	fake := &fakeIPTables{rules: []string{
+		`-A INPUT -p tcp -m tcp --dport 1000:2000 -j ACCEPT`,
+		`-A INPUT -s 10.10.0.18/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`,
+		`-A INPUT -m comment --comment "unterminated -j ACCEPT`,
+		`-A INPUT -s 10.10.0.19/32 -p tcp -m tcp --dport 9100:9104 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`,
+	}}
+	fwm := &FirewallManager{wrapper: fake}
+
+	res, err := fwm.ListManagedFirewallRules()
+	assert.NoError(t, err)
+	assert.Equal(t, []FirewallRule{
+		{IP: "10.10.0.18", Port: NodeExporterPort, RawRule: fake.rules[1]},
+		{IP: "10.10.0.19", Port: 0, RawRule: fake.rules[3], Drift: []string{`destination port "9100:9104" is not a single port`}},
+	}, res)
+
+	// The rule modified by hand is deleted in its raw form
+	assert.NoError(t, fwm.ExecuteRules(Plan{Delete: res[1:]}))
+	assert.NotContains(t, fake.rules, res[1].RawRule)
+
+	fake.rules = append(fake.rules, `-A INPUT -m comment --comment "FW-MANAGER RULE -j ACCEPT`)
+	_, err = fwm.ListManagedFirewallRules()
+	assert.Error(t, err)
+}
+
+// fakeIPTables keeps INPUT chain in memory, rules are stored in the `iptables -S` format.
+// failOn allows injecting an error for the specific operation.
+type fakeIPTables struct {
+	rules  []string
+	failOn func(operation string, rule string) error
+	// lists counts calls of the List
+	lists int
+}
+
+func (f *fakeIPTables) List(table, chain string) ([]string, error) {
+	f.lists++
+	return append([]string{"-P INPUT ACCEPT"}, f.rules...), nil
+}
+
+func (f *fakeIPTables) Delete(table, chain string, rulespec ...string) error {
+	rule := fakeRule(chain, rulespec)
+	if f.failOn != nil {
+		if err := f.failOn("delete", rule); err != nil {
+			return err
 		}
-		res, err := parseRule("-A INPUT -p tcp -m tcp --dport 80 -c 0 0 -j ACCEPT")
-		assert.NoError(t, err)
-		assert.Equal(t, expected, res)
-	})
-
-	t.Run("Parse tcp invalid port", func(t *testing.T) {
-		res, err := parseRule("-A INPUT -p tcp -m tcp --dport 2h2 -c 0 0 -j ACCEPT")
-		assert.Nil(t, res)
-		assert.Error(t, err)
-	})
-
-	t.Run("Parse tcp with comment", func(t *testing.T) {
-		expected := &iptablesRule{
-			chain:   "INPUT",
-			proto:   "tcp",
-			dstPort: 80,
-			comment: "FW-MANAGER RULE",
-			target:  "ACCEPT",
+	}
+
+	idx := slices.Index(f.rules, rule)
+	if idx < 0 {
+		return fmt.Errorf("rule does not exist: %s", rule)
+	}
+	f.rules = slices.Delete(f.rules, idx, idx+1)
+
+	return nil
+}
+
+func (f *fakeIPTables) DeleteIfExists(table, chain string, rulespec ...string) error {
+	if !slices.Contains(f.rules, fakeRule(chain, rulespec)) {
+		return nil
+	}
+
+	return f.Delete(table, chain, rulespec...)
+}
+
+func (f *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return slices.Contains(f.rules, fakeRule(chain, rulespec)), nil
+}
+
+func (f *fakeIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	rule := fakeRule(chain, rulespec)
+	if f.failOn != nil {
+		if err := f.failOn("insert", rule); err != nil {
+			return err
 		}
-		res, err := parseRule(`-A INPUT -p tcp -m tcp --dport 80 -m comment --comment "FW-MANAGER RULE" -c 0 0 -j ACCEPT`)
-		assert.NoError(t, err)
-		assert.Equal(t, expected, res)
-	})
-
-	t.Run("Parse tcp with comment and source", func(t *testing.T) {
-		expected := &iptablesRule{
-			chain:   "INPUT",
-			proto:   "tcp",
-			dstPort: 9100,
-			source:  "10.10.0.18/32",
-			comment: "FW-MANAGER RULE",
-			target:  "ACCEPT",
+	}
+
+	if pos < 1 || pos > len(f.rules)+1 {
+		return fmt.Errorf("index of insertion too big")
+	}
+	f.rules = slices.Insert(f.rules, pos-1, rule)
+
+	return nil
+}
+
+func (f *fakeIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	rule := fakeRule(chain, rulespec)
+	if f.failOn != nil {
+		if err := f.failOn("append", rule); err != nil {
+			return err
 		}
-		res, err := parseRule(`-A INPUT -s 10.10.0.18/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`)
-		assert.NoError(t, err)
-		assert.Equal(t, expected, res)
-	})
+	}
+
+	if !slices.Contains(f.rules, rule) {
+		f.rules = append(f.rules, rule)
+	}
+
+	return nil
+}
+
+func fakeRule(chain string, rulespec []string) string {
+	return joinRuleTokens(append([]string{"-A", chain}, rulespec...))
 }
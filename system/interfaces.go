@@ -5,13 +5,49 @@ import (
 	"net"
 )
 
+// localAddress is the ip address assigned to the local interface
+type localAddress struct {
+	iface string
+	ip    net.IP
+}
+
 func GetLocalIPs() ([]net.IP, error) {
+	addresses, err := getLocalAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []net.IP{}
+	for _, address := range addresses {
+		result = append(result, address.ip)
+	}
+
+	return result, nil
+}
+
+// FindInterfaceByCIDR returns name of the first local interface with an address belonging to the cidr
+func FindInterfaceByCIDR(cidr *net.IPNet) (string, error) {
+	addresses, err := getLocalAddresses()
+	if err != nil {
+		return "", err
+	}
+
+	for _, address := range addresses {
+		if cidr.Contains(address.ip) {
+			return address.iface, nil
+		}
+	}
+
+	return "", fmt.Errorf("none of the local interfaces has an address in the %s network", cidr)
+}
+
+func getLocalAddresses() ([]localAddress, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list network interfaces: %w", err)
 	}
 
-	result := []net.IP{}
+	result := []localAddress{}
 	for _, i := range interfaces {
 		addrs, err := i.Addrs()
 		if err != nil {
@@ -26,7 +62,7 @@ func GetLocalIPs() ([]net.IP, error) {
 				ip = v.IP
 			}
 
-			result = append(result, ip)
+			result = append(result, localAddress{iface: i.Name, ip: ip})
 		}
 	}
 
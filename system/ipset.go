@@ -0,0 +1,439 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	// IPSetPrefix is the prefix of every ipset managed by fw-manager. Sets without it are never touched.
+	IPSetPrefix = "fwm"
+
+	// ManagedSetComment marks iptables rules matching the managed ipsets. It differs from the ManagedComment,
+	// so per-peer rules and set rules can be listed and reconciled independently.
+	ManagedSetComment = "FW-MANAGER SET"
+
+	ipsetType       = "hash:ip"
+	ipsetTempSuffix = "-tmp"
+)
+
+// ipsetRunFunc executes the ipset binary with given arguments and optional stdin and returns its output.
+type ipsetRunFunc func(stdin io.Reader, args ...string) ([]byte, error)
+
+type IPSetManager struct {
+	wrapper   iptablesWrapper
+	placement RulePlacement
+	run       ipsetRunFunc
+	// applied is the journal of the last successful ExecuteSets, it is undone by the RevertSets
+	applied *setJournal
+}
+
+// IPSet describes one managed hash:ip set. Every set is matched by exactly one iptables rule
+// accepting the Proto traffic on the Port.
+type IPSet struct {
+	Name    string
+	Proto   string
+	Port    RulePort
+	Members []RuleIP
+	// Interface is the input interface the set rule is bound to, empty means any interface
+	Interface string `json:",omitempty"`
+}
+
+// IPSetChange describes how a single set has to be modified to reach the desired state.
+type IPSetChange struct {
+	Set    IPSet
+	Add    []RuleIP
+	Delete []RuleIP
+}
+
+// IPSetExecutionPlan groups sets which needs to be created, updated or destroyed.
+type IPSetExecutionPlan struct {
+	Create  []IPSet
+	Update  []IPSetChange
+	Destroy []IPSet
+}
+
+func (plan IPSetExecutionPlan) Empty() bool {
+	return len(plan.Create) == 0 && len(plan.Update) == 0 && len(plan.Destroy) == 0
+}
+
+func NewIPSetManager(wrapper *iptables.IPTables) (*IPSetManager, error) {
+	if wrapper == nil {
+		var err error
+		wrapper, err = iptables.New()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create iptables wrapper: %w", err)
+		}
+	}
+
+	if _, err := exec.LookPath("ipset"); err != nil {
+		return nil, fmt.Errorf("failed to find the ipset binary: %w", err)
+	}
+
+	return &IPSetManager{
+		wrapper: wrapper,
+		run:     execIPSet,
+	}, nil
+}
+
+// SetPlacement changes where the set rules are located in the chain, rules are appended by default.
+func (ipsm *IPSetManager) SetPlacement(placement RulePlacement) {
+	ipsm.placement = placement
+}
+
+// IPSetName returns name of the managed set for given protocol and port, e.g: `fwm-tcp-9100`
+func IPSetName(proto string, port RulePort) string {
+	return fmt.Sprintf("%s-%s-%d", IPSetPrefix, proto, port)
+}
+
+// parseIPSetName is reverse of the IPSetName. It returns false when name does not belong to the managed set.
+func parseIPSetName(name string) (string, RulePort, bool) {
+	parts := strings.Split(name, "-")
+	if len(parts) != 3 || parts[0] != IPSetPrefix {
+		return "", 0, false
+	}
+
+	port, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", 0, false
+	}
+
+	return parts[1], RulePort(port), true
+}
+
+// GroupRulesBySets converts per peer rules into sets, one set per port. All managed rules are tcp.
+func GroupRulesBySets(rules []FirewallRule) []IPSet {
+	sets := map[string]*IPSet{}
+	for _, rule := range rules {
+		name := IPSetName("tcp", rule.Port)
+		if _, exists := sets[name]; !exists {
+			sets[name] = &IPSet{
+				Name:      name,
+				Proto:     "tcp",
+				Port:      rule.Port,
+				Members:   []RuleIP{},
+				Interface: rule.Interface,
+			}
+		}
+
+		if !slices.Contains(sets[name].Members, rule.IP) {
+			sets[name].Members = append(sets[name].Members, rule.IP)
+		}
+	}
+
+	result := []IPSet{}
+	for _, set := range sets {
+		result = append(result, *set)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// ListManagedSets returns all sets created by fw-manager with their members
+func (ipsm *IPSetManager) ListManagedSets() ([]IPSet, error) {
+	out, err := ipsm.run(nil, "save")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ipsets: %w", err)
+	}
+
+	return parseIPSetSave(bytes.NewReader(out))
+}
+
+// parseIPSetSave parses output of the `ipset save` command and returns only managed sets.
+//
+// Example output:
+//
+//	create fwm-tcp-9100 hash:ip family inet hashsize 1024 maxelem 65536
+//	add fwm-tcp-9100 10.10.0.17
+func parseIPSetSave(r io.Reader) ([]IPSet, error) {
+	sets := []IPSet{}
+	setIdx := map[string]int{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		proto, port, managed := parseIPSetName(fields[1])
+		if !managed {
+			continue
+		}
+
+		switch fields[0] {
+		case "create":
+			setIdx[fields[1]] = len(sets)
+			sets = append(sets, IPSet{
+				Name:    fields[1],
+				Proto:   proto,
+				Port:    port,
+				Members: []RuleIP{},
+			})
+		case "add":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("missing member in the ipset entry: %s", scanner.Text())
+			}
+			idx, exists := setIdx[fields[1]]
+			if !exists {
+				return nil, fmt.Errorf("member added to the undefined set %s", fields[1])
+			}
+			sets[idx].Members = append(sets[idx].Members, RuleIP(fields[2]))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ipset save output: %w", err)
+	}
+
+	return sets, nil
+}
+
+// PrepareIPSetExecutionPlan compares existing and desired sets. Members of the sets existing on both sides
+// are compared with the PrepareRulesExecutionPlan.
+func PrepareIPSetExecutionPlan(existingSets []IPSet, newSets []IPSet) IPSetExecutionPlan {
+	plan := IPSetExecutionPlan{
+		Create:  []IPSet{},
+		Update:  []IPSetChange{},
+		Destroy: []IPSet{},
+	}
+
+	for _, existingSet := range existingSets {
+		if !slices.ContainsFunc(newSets, func(s IPSet) bool { return s.Name == existingSet.Name }) {
+			plan.Destroy = append(plan.Destroy, existingSet)
+		}
+	}
+
+	for _, newSet := range newSets {
+		idx := slices.IndexFunc(existingSets, func(s IPSet) bool { return s.Name == newSet.Name })
+		if idx < 0 {
+			plan.Create = append(plan.Create, newSet)
+			continue
+		}
+
+		membersPlan := PrepareRulesExecutionPlan(setMembersToRules(existingSets[idx]), setMembersToRules(newSet))
+		if membersPlan.Empty() {
+			continue
+		}
+
+		plan.Update = append(plan.Update, IPSetChange{
+			Set:    newSet,
+			Add:    rulesToSetMembers(membersPlan.Add),
+			Delete: rulesToSetMembers(membersPlan.Delete),
+		})
+	}
+
+	return plan
+}
+
+// ExecuteSets applies the plan. Content of created and updated sets is loaded into a temporary set
+// and swapped with the live one, so the traffic never sees partially updated set. When any step fails,
+// already applied steps are undone and the *ApplyError is returned.
+func (ipsm *IPSetManager) ExecuteSets(plan IPSetExecutionPlan, desiredSets []IPSet) error {
+	journal := &setJournal{}
+
+	for _, set := range plan.Destroy {
+		if err := ipsm.deleteSetRule(set, journal); err != nil {
+			return ipsm.rollback(journal, fmt.Errorf("failed to delete iptables rule for the %s set: %w", set.Name, err))
+		}
+
+		if _, err := ipsm.run(nil, "destroy", set.Name); err != nil {
+			return ipsm.rollback(journal, fmt.Errorf("failed to destroy the %s set: %w", set.Name, err))
+		}
+		journal.record(operationDestroySet, set, nil, 0)
+	}
+
+	for _, set := range plan.Create {
+		if _, err := ipsm.run(strings.NewReader(ipsetRestoreScript(set)), "restore"); err != nil {
+			return ipsm.rollback(journal, fmt.Errorf("failed to swap content of the %s set: %w", set.Name, err))
+		}
+		journal.record(operationCreateSet, set, nil, 0)
+	}
+
+	for _, change := range plan.Update {
+		if _, err := ipsm.run(strings.NewReader(ipsetRestoreScript(change.Set)), "restore"); err != nil {
+			return ipsm.rollback(journal, fmt.Errorf("failed to swap content of the %s set: %w", change.Set.Name, err))
+		}
+		journal.record(operationSwapSet, change.previous(), nil, 0)
+	}
+
+	// Rules for all desired sets are ensured, so the rule removed or moved by hand is brought back
+	// even if content of the set did not change.
+	for _, set := range desiredSets {
+		if err := ipsm.ensureSetRule(set, journal); err != nil {
+			return ipsm.rollback(journal, fmt.Errorf("failed to ensure iptables rule for the %s set: %w", set.Name, err))
+		}
+	}
+	ipsm.applied = journal
+
+	return nil
+}
+
+// previous returns the set with the content it had before the change
+func (change IPSetChange) previous() IPSet {
+	set := change.Set
+	set.Members = []RuleIP{}
+	for _, member := range change.Set.Members {
+		if !slices.Contains(change.Add, member) {
+			set.Members = append(set.Members, member)
+		}
+	}
+	set.Members = append(set.Members, change.Delete...)
+
+	return set
+}
+
+// ensureSetRule adds the rule matching the set when it is missing and replaces it when it is misplaced
+// or bound to other interface
+func (ipsm *IPSetManager) ensureSetRule(set IPSet, journal *setJournal) error {
+	rules, err := listChainRules(ipsm.wrapper)
+	if err != nil {
+		return err
+	}
+
+	lower, upper, err := ipsm.placement.bounds(rules)
+	if err != nil {
+		return fmt.Errorf("failed to check placement of the set rule: %w", err)
+	}
+
+	if idx := findSetRule(rules, set); idx >= 0 {
+		if ipsm.placement.misplacement(idx, lower, upper) == "" && rules[idx].parsed.inInterface == set.Interface {
+			return nil
+		}
+
+		rulespec := rawRuleSpec(rules[idx].raw)
+		if err := ipsm.wrapper.Delete(IptablesTableFilter, IptablesChainInput, rulespec...); err != nil {
+			return fmt.Errorf("failed to delete outdated rule: %w", err)
+		}
+		journal.record(operationDeleteSetRule, set, rulespec, idx+1)
+	}
+
+	position, err := placementPosition(ipsm.wrapper, ipsm.placement)
+	if err != nil {
+		return fmt.Errorf("failed to find position for the set rule: %w", err)
+	}
+
+	changed, err := placeRule(ipsm.wrapper, position, setRuleSpec(set))
+	if err != nil {
+		return err
+	}
+	if changed {
+		journal.record(operationPlaceSetRule, set, setRuleSpec(set), 0)
+	}
+
+	return nil
+}
+
+// deleteSetRule deletes the rule matching the set in the form it exists in the chain
+func (ipsm *IPSetManager) deleteSetRule(set IPSet, journal *setJournal) error {
+	rules, err := listChainRules(ipsm.wrapper)
+	if err != nil {
+		return err
+	}
+
+	idx := findSetRule(rules, set)
+	if idx < 0 {
+		return nil
+	}
+
+	rulespec := rawRuleSpec(rules[idx].raw)
+	if err := ipsm.wrapper.Delete(IptablesTableFilter, IptablesChainInput, rulespec...); err != nil {
+		return err
+	}
+	journal.record(operationDeleteSetRule, set, rulespec, idx+1)
+
+	return nil
+}
+
+// findSetRule returns index of the rule matching source addresses against the set, -1 when rule does not exist
+func findSetRule(rules []chainRule, set IPSet) int {
+	for idx, rule := range rules {
+		if rule.parsed == nil || rule.parsed.comment != ManagedSetComment {
+			continue
+		}
+
+		if rule.parsed.matchSet == set.Name && rule.parsed.matchSetFlags == "src" && !rule.parsed.isNegated("matchSet") {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// ipsetRestoreScript prepares input for the `ipset restore` which fills the temporary set
+// and atomically swaps it with the live one.
+func ipsetRestoreScript(set IPSet) string {
+	tmpName := set.Name + ipsetTempSuffix
+
+	script := &strings.Builder{}
+	fmt.Fprintf(script, "create %s %s family inet -exist\n", set.Name, ipsetType)
+	fmt.Fprintf(script, "create %s %s family inet -exist\n", tmpName, ipsetType)
+	fmt.Fprintf(script, "flush %s\n", tmpName)
+	for _, member := range set.Members {
+		fmt.Fprintf(script, "add %s %s\n", tmpName, member)
+	}
+	fmt.Fprintf(script, "swap %s %s\n", tmpName, set.Name)
+	fmt.Fprintf(script, "destroy %s\n", tmpName)
+
+	return script.String()
+}
+
+// sudo iptables -A INPUT -i wg0 -p tcp -m tcp --dport 9100 -m set --match-set fwm-tcp-9100 src -m comment --comment "FW-MANAGER SET" -j ACCEPT
+func setRuleSpec(set IPSet) []string {
+	spec := []string{}
+	if set.Interface != "" {
+		spec = append(spec, "-i", set.Interface)
+	}
+
+	return append(spec,
+		"-p", set.Proto,
+		"-m", set.Proto,
+		"--dport", fmt.Sprintf("%d", set.Port),
+		"-m", "set", "--match-set", set.Name, "src",
+		"-m", "comment", "--comment", ManagedSetComment,
+		"-j", "ACCEPT",
+	)
+}
+
+func setMembersToRules(set IPSet) []FirewallRule {
+	result := []FirewallRule{}
+	for _, member := range set.Members {
+		result = append(result, FirewallRule{IP: member, Port: set.Port})
+	}
+
+	return result
+}
+
+func rulesToSetMembers(rules []FirewallRule) []RuleIP {
+	result := []RuleIP{}
+	for _, rule := range rules {
+		result = append(result, rule.IP)
+	}
+
+	return result
+}
+
+func execIPSet(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("ipset", args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("ipset %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return out, nil
+}
@@ -0,0 +1,202 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIPSetSave(t *testing.T) {
+	t.Run("Parse managed and unmanaged sets", func(t *testing.T) {
+		out := `create fwm-tcp-9100 hash:ip family inet hashsize 1024 maxelem 65536
+add fwm-tcp-9100 10.10.0.17
+add fwm-tcp-9100 10.10.0.18
+create docker-hosts hash:ip family inet hashsize 1024 maxelem 65536
+add docker-hosts 172.17.0.2
+create fwm-tcp-5141 hash:ip family inet hashsize 1024 maxelem 65536
+`
+		expected := []IPSet{
+			{Name: "fwm-tcp-9100", Proto: "tcp", Port: 9100, Members: []RuleIP{"10.10.0.17", "10.10.0.18"}},
+			{Name: "fwm-tcp-5141", Proto: "tcp", Port: 5141, Members: []RuleIP{}},
+		}
+
+		res, err := parseIPSetSave(strings.NewReader(out))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res)
+	})
+
+	t.Run("Parse member of undefined set", func(t *testing.T) {
+		res, err := parseIPSetSave(strings.NewReader("add fwm-tcp-9100 10.10.0.17\n"))
+		assert.Nil(t, res)
+		assert.Error(t, err)
+	})
+}
+
+func TestGroupRulesBySets(t *testing.T) {
+	rules := []FirewallRule{
+		{IP: "10.10.10.1", Port: NodeExporterPort},
+		{IP: "10.10.10.2", Port: NodeExporterPort},
+		{IP: "10.10.10.1", Port: NodeExporterPort},
+		{IP: "10.10.20.1", Port: MySQLPort},
+	}
+
+	expected := []IPSet{
+		{Name: "fwm-tcp-3306", Proto: "tcp", Port: MySQLPort, Members: []RuleIP{"10.10.20.1"}},
+		{Name: "fwm-tcp-9100", Proto: "tcp", Port: NodeExporterPort, Members: []RuleIP{"10.10.10.1", "10.10.10.2"}},
+	}
+
+	assert.Equal(t, expected, GroupRulesBySets(rules))
+}
+
+func TestPrepareIPSetExecutionPlan(t *testing.T) {
+	existing := []IPSet{
+		{Name: "fwm-tcp-3306", Proto: "tcp", Port: MySQLPort, Members: []RuleIP{"10.10.20.1"}},
+		{Name: "fwm-tcp-9100", Proto: "tcp", Port: NodeExporterPort, Members: []RuleIP{"10.10.10.1", "10.10.10.3"}},
+		{Name: "fwm-tcp-9104", Proto: "tcp", Port: MySQLExportedPort, Members: []RuleIP{"10.10.10.1"}},
+	}
+	desired := []IPSet{
+		{Name: "fwm-tcp-5141", Proto: "tcp", Port: LogstashPort, Members: []RuleIP{"10.10.0.1"}},
+		{Name: "fwm-tcp-9100", Proto: "tcp", Port: NodeExporterPort, Members: []RuleIP{"10.10.10.1", "10.10.10.2"}},
+		{Name: "fwm-tcp-9104", Proto: "tcp", Port: MySQLExportedPort, Members: []RuleIP{"10.10.10.1"}},
+	}
+
+	plan := PrepareIPSetExecutionPlan(existing, desired)
+	assert.Equal(t, []IPSet{desired[0]}, plan.Create)
+	assert.Equal(t, []IPSet{existing[0]}, plan.Destroy)
+	assert.Equal(t, []IPSetChange{
+		{Set: desired[1], Add: []RuleIP{"10.10.10.2"}, Delete: []RuleIP{"10.10.10.3"}},
+	}, plan.Update)
+
+	plan = PrepareIPSetExecutionPlan(desired, desired)
+	assert.True(t, plan.Empty())
+}
+
+func TestIPSetRestoreScript(t *testing.T) {
+	expected := `create fwm-tcp-9100 hash:ip family inet -exist
+create fwm-tcp-9100-tmp hash:ip family inet -exist
+flush fwm-tcp-9100-tmp
+add fwm-tcp-9100-tmp 10.10.10.1
+add fwm-tcp-9100-tmp 10.10.10.2
+swap fwm-tcp-9100-tmp fwm-tcp-9100
+destroy fwm-tcp-9100-tmp
+`
+	set := IPSet{Name: "fwm-tcp-9100", Proto: "tcp", Port: NodeExporterPort, Members: []RuleIP{"10.10.10.1", "10.10.10.2"}}
+
+	assert.Equal(t, expected, ipsetRestoreScript(set))
+}
+
+func TestExecuteSetsRollback(t *testing.T) {
+	destroyed := IPSet{Name: "fwm-tcp-3306", Proto: "tcp", Port: MySQLPort, Members: []RuleIP{"10.10.20.1"}}
+	created := IPSet{Name: "fwm-tcp-9100", Proto: "tcp", Port: NodeExporterPort, Members: []RuleIP{"10.10.10.1"}}
+	failed := IPSet{Name: "fwm-tcp-9104", Proto: "tcp", Port: MySQLExportedPort, Members: []RuleIP{"10.10.10.1"}}
+
+	fake := &fakeIPTables{rules: []string{
+		fakeRule(IptablesChainInput, setRuleSpec(destroyed)),
+		"-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT",
+	}}
+	before := append([]string{}, fake.rules...)
+
+	calls := []string{}
+	ipsm := &IPSetManager{
+		wrapper: fake,
+		run: func(stdin io.Reader, args ...string) ([]byte, error) {
+			call := strings.Join(args, " ")
+			if stdin != nil {
+				script, _ := io.ReadAll(stdin)
+				call += "\n" + string(script)
+			}
+			calls = append(calls, call)
+
+			if strings.Contains(call, "add "+failed.Name) {
+				return nil, fmt.Errorf("ipset: resource temporarily unavailable")
+			}
+			return nil, nil
+		},
+	}
+
+	err := ipsm.ExecuteSets(IPSetExecutionPlan{
+		Create:  []IPSet{created, failed},
+		Destroy: []IPSet{destroyed},
+	}, []IPSet{created, failed})
+
+	applyErr := &ApplyError{}
+	assert.True(t, errors.As(err, &applyErr))
+	assert.True(t, applyErr.Restored())
+	// rule delete, destroy and create were undone
+	assert.Equal(t, 3, applyErr.RolledBack)
+	assert.Equal(t, before, fake.rules)
+	assert.Equal(t, []string{
+		"destroy " + destroyed.Name,
+		"restore\n" + ipsetRestoreScript(created),
+		"restore\n" + ipsetRestoreScript(failed),
+		"destroy " + created.Name,
+		"restore\n" + ipsetRestoreScript(destroyed),
+	}, calls)
+}
+
+func TestIPSetChangePrevious(t *testing.T) {
+	change := IPSetChange{
+		Set:    IPSet{Name: "fwm-tcp-9100", Proto: "tcp", Port: NodeExporterPort, Members: []RuleIP{"10.10.10.1", "10.10.10.2"}},
+		Add:    []RuleIP{"10.10.10.2"},
+		Delete: []RuleIP{"10.10.10.3"},
+	}
+
+	assert.Equal(t, []RuleIP{"10.10.10.1", "10.10.10.3"}, change.previous().Members)
+	assert.Len(t, change.Set.Members, 2)
+}
+
+func TestFindSetRule(t *testing.T) {
+	set := IPSet{Name: "fwm-tcp-9100", Proto: "tcp", Port: NodeExporterPort}
+	fake := &fakeIPTables{rules: []string{
+		`-A INPUT -p tcp -m set --match-set fwm-tcp-9100 dst -m comment --comment "FW-MANAGER SET" -j ACCEPT`,
+		`-A INPUT -p tcp -m set ! --match-set fwm-tcp-9100 src -m comment --comment "FW-MANAGER SET" -j ACCEPT`,
+		`-A INPUT -p tcp -m set --match-set fwm-tcp-9104 src -m comment --comment "FW-MANAGER SET" -j LOG --log-prefix fwm-tcp-9100`,
+	}}
+
+	rules, err := listChainRules(fake)
+	assert.NoError(t, err)
+	assert.Equal(t, -1, findSetRule(rules, set))
+
+	fake.rules = append(fake.rules, fakeRule(IptablesChainInput, setRuleSpec(set)))
+	rules, err = listChainRules(fake)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, findSetRule(rules, set))
+}
+
+func TestRevertSets(t *testing.T) {
+	created := IPSet{Name: "fwm-tcp-9100", Proto: "tcp", Port: NodeExporterPort, Members: []RuleIP{"10.10.10.1"}}
+	fake := &fakeIPTables{rules: []string{"-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT"}}
+	before := append([]string{}, fake.rules...)
+
+	calls := []string{}
+	ipsm := &IPSetManager{
+		wrapper: fake,
+		run: func(stdin io.Reader, args ...string) ([]byte, error) {
+			calls = append(calls, strings.Join(args, " "))
+			return nil, nil
+		},
+	}
+
+	assert.NoError(t, ipsm.ExecuteSets(IPSetExecutionPlan{Create: []IPSet{created}}, []IPSet{created}))
+	assert.Len(t, fake.rules, 2)
+
+	// rules applied after the sets failed and were rolled back
+	rulesErr := &ApplyError{Err: fmt.Errorf("iptables: resource temporarily unavailable"), RolledBack: 2}
+	err := ipsm.RevertSets(rulesErr)
+
+	applyErr := &ApplyError{}
+	assert.True(t, errors.As(err, &applyErr))
+	assert.True(t, applyErr.Restored())
+	// set rule and the set were undone together with the rules
+	assert.Equal(t, 4, applyErr.RolledBack)
+	assert.Equal(t, before, fake.rules)
+	assert.Equal(t, []string{"restore", "destroy " + created.Name}, calls)
+
+	// sets are reverted only once
+	cause := fmt.Errorf("failed")
+	assert.Equal(t, cause, ipsm.RevertSets(cause))
+}
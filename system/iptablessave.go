@@ -0,0 +1,270 @@
+package system
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// IptablesSave is the ruleset read from the `iptables-save` output. It implements the same operations
+// as the iptables binary, so the FirewallManager can plan and apply rules without access to the host.
+type IptablesSave struct {
+	tables []*savedTable
+}
+
+type savedTable struct {
+	name string
+	// chains keeps chain definitions in the original order, e.g: `:INPUT ACCEPT [0:0]`
+	chains []string
+	// rules keeps rules of all the chains in the original order, e.g: `-A INPUT -j ACCEPT`
+	rules []savedRule
+}
+
+type savedRule struct {
+	raw    string
+	tokens []string
+}
+
+// ReadIptablesSave parses the `iptables-save` output. Comments are dropped.
+func ReadIptablesSave(r io.Reader) (*IptablesSave, error) {
+	result := &IptablesSave{}
+
+	var current *savedTable
+	lineNo := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+
+		case strings.HasPrefix(line, "*"):
+			if current != nil {
+				return nil, fmt.Errorf("line %d: table %s started before COMMIT of the %s table", lineNo, line[1:], current.name)
+			}
+			current = &savedTable{name: line[1:]}
+
+		case line == "COMMIT":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: COMMIT outside of the table", lineNo)
+			}
+			result.tables = append(result.tables, current)
+			current = nil
+
+		case current == nil:
+			return nil, fmt.Errorf("line %d: entry outside of the table: %s", lineNo, line)
+
+		case strings.HasPrefix(line, ":"):
+			current.chains = append(current.chains, line)
+
+		case strings.HasPrefix(line, "-A "):
+			tokens, err := tokenizeRule(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid rule: %w", lineNo, err)
+			}
+			current.rules = append(current.rules, savedRule{raw: line, tokens: tokens})
+
+		default:
+			return nil, fmt.Errorf("line %d: unsupported entry: %s", lineNo, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read iptables-save input: %w", err)
+	}
+	if current != nil {
+		return nil, fmt.Errorf("missing COMMIT for the %s table", current.name)
+	}
+
+	return result, nil
+}
+
+// WriteTo writes the ruleset in the format accepted by the `iptables-restore`
+func (s *IptablesSave) WriteTo(w io.Writer) (int64, error) {
+	out := &strings.Builder{}
+	out.WriteString("# Generated by fw-manager\n")
+	for _, table := range s.tables {
+		fmt.Fprintf(out, "*%s\n", table.name)
+		for _, chain := range table.chains {
+			fmt.Fprintln(out, chain)
+		}
+		for _, rule := range table.rules {
+			fmt.Fprintln(out, rule.raw)
+		}
+		out.WriteString("COMMIT\n")
+	}
+
+	written, err := io.WriteString(w, out.String())
+
+	return int64(written), err
+}
+
+func (s *IptablesSave) table(name string) (*savedTable, error) {
+	for _, table := range s.tables {
+		if table.name == name {
+			return table, nil
+		}
+	}
+
+	return nil, fmt.Errorf("table %s not found in the iptables-save input", name)
+}
+
+// chainPolicy returns the policy of the built-in chain or `-` for user defined chain
+func (t *savedTable) chainPolicy(chain string) (string, error) {
+	for _, definition := range t.chains {
+		fields := strings.Fields(definition)
+		if len(fields) >= 2 && fields[0] == ":"+chain {
+			return fields[1], nil
+		}
+	}
+
+	return "", fmt.Errorf("chain %s not found in the %s table", chain, t.name)
+}
+
+// chainRuleIndexes returns indexes of the table rules which belong to the chain
+func (t *savedTable) chainRuleIndexes(chain string) []int {
+	result := []int{}
+	for idx, rule := range t.rules {
+		if rule.tokens[1] == chain {
+			result = append(result, idx)
+		}
+	}
+
+	return result
+}
+
+// findRule returns index of the table rule equal to the rulespec, rules are compared token by token
+func (t *savedTable) findRule(chain string, rulespec []string) int {
+	expected := append([]string{"-A", chain}, rulespec...)
+	for _, idx := range t.chainRuleIndexes(chain) {
+		if slices.Equal(t.rules[idx].tokens, expected) {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// insertRule adds the rule before the table rule with given index, index equal to -1 means after the last rule of the chain
+func (t *savedTable) insertRule(chain string, idx int, rulespec []string) {
+	tokens := append([]string{"-A", chain}, rulespec...)
+	rule := savedRule{raw: joinRuleTokens(tokens), tokens: tokens}
+
+	if idx < 0 {
+		indexes := t.chainRuleIndexes(chain)
+		if len(indexes) == 0 {
+			t.rules = append(t.rules, rule)
+			return
+		}
+		idx = indexes[len(indexes)-1] + 1
+	}
+
+	t.rules = slices.Insert(t.rules, idx, rule)
+}
+
+// List returns rules in the `iptables -S <chain>` format
+func (s *IptablesSave) List(table, chain string) ([]string, error) {
+	t, err := s.table(table)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := t.chainPolicy(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	if policy == "-" {
+		result = append(result, fmt.Sprintf("-N %s", chain))
+	} else {
+		result = append(result, fmt.Sprintf("-P %s %s", chain, policy))
+	}
+	for _, idx := range t.chainRuleIndexes(chain) {
+		result = append(result, t.rules[idx].raw)
+	}
+
+	return result, nil
+}
+
+func (s *IptablesSave) Delete(table, chain string, rulespec ...string) error {
+	t, err := s.table(table)
+	if err != nil {
+		return err
+	}
+
+	idx := t.findRule(chain, rulespec)
+	if idx < 0 {
+		return fmt.Errorf("bad rule (does a matching rule exist in that chain?): %s", joinRuleTokens(rulespec))
+	}
+	t.rules = slices.Delete(t.rules, idx, idx+1)
+
+	return nil
+}
+
+func (s *IptablesSave) DeleteIfExists(table, chain string, rulespec ...string) error {
+	t, err := s.table(table)
+	if err != nil {
+		return err
+	}
+
+	if t.findRule(chain, rulespec) < 0 {
+		return nil
+	}
+
+	return s.Delete(table, chain, rulespec...)
+}
+
+func (s *IptablesSave) Exists(table, chain string, rulespec ...string) (bool, error) {
+	t, err := s.table(table)
+	if err != nil {
+		return false, err
+	}
+
+	return t.findRule(chain, rulespec) >= 0, nil
+}
+
+func (s *IptablesSave) AppendUnique(table, chain string, rulespec ...string) error {
+	t, err := s.table(table)
+	if err != nil {
+		return err
+	}
+	if _, err := t.chainPolicy(chain); err != nil {
+		return err
+	}
+
+	if t.findRule(chain, rulespec) >= 0 {
+		return nil
+	}
+
+	t.insertRule(chain, -1, rulespec)
+
+	return nil
+}
+
+// Insert adds the rule at the 1-based position in the chain
+func (s *IptablesSave) Insert(table, chain string, pos int, rulespec ...string) error {
+	t, err := s.table(table)
+	if err != nil {
+		return err
+	}
+	if _, err := t.chainPolicy(chain); err != nil {
+		return err
+	}
+
+	indexes := t.chainRuleIndexes(chain)
+	if pos < 1 || pos > len(indexes)+1 {
+		return fmt.Errorf("index of insertion too big: %d", pos)
+	}
+	if pos == len(indexes)+1 {
+		t.insertRule(chain, -1, rulespec)
+		return nil
+	}
+	t.insertRule(chain, indexes[pos-1], rulespec)
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package system
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIptablesSave(t *testing.T) {
+	t.Run("Write keeps tables, chains and rules", func(t *testing.T) {
+		file, err := os.Open("testdata/iptables-save.txt")
+		assert.NoError(t, err)
+		defer file.Close()
+
+		ruleset, err := ReadIptablesSave(file)
+		assert.NoError(t, err)
+
+		out := &strings.Builder{}
+		_, err = ruleset.WriteTo(out)
+		assert.NoError(t, err)
+
+		expected := []string{"# Generated by fw-manager"}
+		for _, line := range strings.Split(strings.TrimSpace(iptablesSaveSample(t)), "\n") {
+			if !strings.HasPrefix(line, "#") {
+				expected = append(expected, line)
+			}
+		}
+		assert.Equal(t, strings.Join(expected, "\n")+"\n", out.String())
+	})
+
+	t.Run("Apply rules offline", func(t *testing.T) {
+		ruleset, err := ReadIptablesSave(strings.NewReader(`*filter
+:INPUT DROP [0:0]
+:FORWARD DROP [0:0]
+-A INPUT -i lo -j ACCEPT
+-A FORWARD -j DROP
+-A INPUT -s 10.10.0.17/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT
+-A INPUT -j REJECT --reject-with icmp-port-unreachable
+COMMIT
+`))
+		assert.NoError(t, err)
+
+		placement, err := ParseRulePlacement("before:-j REJECT")
+		assert.NoError(t, err)
+
+		fwm := NewOfflineFirewallManager(ruleset)
+		fwm.SetPlacement(placement)
+
+		existing, err := fwm.ListManagedFirewallRules()
+		assert.NoError(t, err)
+
+		plan := PrepareRulesExecutionPlan(existing, []FirewallRule{
+			{IP: "10.10.0.18", Port: NodeExporterPort},
+			{IP: "10.10.0.19", Port: NodeExporterPort},
+		})
+		assert.NoError(t, fwm.ExecuteRules(plan))
+
+		out := &strings.Builder{}
+		_, err = ruleset.WriteTo(out)
+		assert.NoError(t, err)
+		assert.Equal(t, `# Generated by fw-manager
+*filter
+:INPUT DROP [0:0]
+:FORWARD DROP [0:0]
+-A INPUT -i lo -j ACCEPT
+-A FORWARD -j DROP
+-A INPUT -s 10.10.0.18/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT
+-A INPUT -s 10.10.0.19/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT
+-A INPUT -j REJECT --reject-with icmp-port-unreachable
+COMMIT
+`, out.String())
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		for _, input := range []string{
+			"-A INPUT -j ACCEPT\n",
+			"*filter\n:INPUT ACCEPT [0:0]\n",
+			"*filter\n*nat\nCOMMIT\n",
+			"*filter\n-A INPUT -m comment --comment \"unterminated\nCOMMIT\n",
+			"*filter\n-I INPUT -j ACCEPT\nCOMMIT\n",
+		} {
+			_, err := ReadIptablesSave(strings.NewReader(input))
+			assert.Error(t, err, input)
+		}
+	})
+}
+
+func iptablesSaveSample(t *testing.T) string {
+	data, err := os.ReadFile("testdata/iptables-save.txt")
+	assert.NoError(t, err)
+
+	return string(data)
+}
@@ -0,0 +1,179 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type ruleOperationType string
+
+const (
+	operationAppend ruleOperationType = "append"
+	operationDelete ruleOperationType = "delete"
+)
+
+type ruleOperation struct {
+	operation ruleOperationType
+	rule      FirewallRule
+	// position is the 1-based position the deleted rule had in the chain, 0 when unknown
+	position int
+}
+
+// ruleJournal keeps the operations applied in a single run in the order they were executed.
+type ruleJournal struct {
+	operations []ruleOperation
+}
+
+func (j *ruleJournal) record(operation ruleOperationType, rule FirewallRule, position int) {
+	j.operations = append(j.operations, ruleOperation{
+		operation: operation,
+		rule:      rule,
+		position:  position,
+	})
+}
+
+// ApplyError is returned when the execution failed in the middle of the run.
+type ApplyError struct {
+	// Err is the error of the failed operation
+	Err error
+	// RolledBack is the number of already applied operations that were undone
+	RolledBack int
+	// RollbackErr is not nil when the journal could not be fully undone
+	RollbackErr error
+}
+
+func (e *ApplyError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf(
+			"%s; rollback failed after undoing %d operations, the host is left with partially applied ruleset: %s",
+			e.Err, e.RolledBack, e.RollbackErr,
+		)
+	}
+
+	return fmt.Sprintf("%s; %d applied operations were undone, the host was restored to its pre-run ruleset", e.Err, e.RolledBack)
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// Restored reports if the host ended with the same ruleset as before the run
+func (e *ApplyError) Restored() bool {
+	return e.RollbackErr == nil
+}
+
+// rollback undoes the journal in the reverse order and wraps the cause in the *ApplyError.
+func (fwm *FirewallManager) rollback(journal *ruleJournal, cause error) error {
+	applyErr := &ApplyError{Err: cause}
+
+	rollbackErrs := []error{}
+	for idx := len(journal.operations) - 1; idx >= 0; idx-- {
+		op := journal.operations[idx]
+
+		var err error
+		switch op.operation {
+		case operationAppend:
+			err = fwm.deleteRule(op.rule)
+		case operationDelete:
+			err = fwm.restoreRule(op.rule, op.position)
+		}
+
+		if err != nil {
+			rollbackErrs = append(rollbackErrs, fmt.Errorf("failed to undo %s of rule with port %d and user %s: %w", op.operation, op.rule.Port, op.rule.IP, err))
+			continue
+		}
+		applyErr.RolledBack++
+	}
+
+	applyErr.RollbackErr = errors.Join(rollbackErrs...)
+
+	return applyErr
+}
+
+type setOperationType string
+
+const (
+	operationCreateSet     setOperationType = "create set"
+	operationSwapSet       setOperationType = "swap set"
+	operationDestroySet    setOperationType = "destroy set"
+	operationPlaceSetRule  setOperationType = "place set rule"
+	operationDeleteSetRule setOperationType = "delete set rule"
+)
+
+type setOperation struct {
+	operation setOperationType
+	// set is the content the set had before the operation, for the created set it is the new set
+	set IPSet
+	// rulespec and position describe the set rule, position is 1-based and set only for the deleted rule
+	rulespec []string
+	position int
+}
+
+// setJournal keeps the ipset operations applied in a single run in the order they were executed.
+type setJournal struct {
+	operations []setOperation
+}
+
+func (j *setJournal) record(operation setOperationType, set IPSet, rulespec []string, position int) {
+	j.operations = append(j.operations, setOperation{
+		operation: operation,
+		set:       set,
+		rulespec:  rulespec,
+		position:  position,
+	})
+}
+
+// rollback undoes the set journal in the reverse order and wraps the cause in the *ApplyError.
+func (ipsm *IPSetManager) rollback(journal *setJournal, cause error) error {
+	applyErr := &ApplyError{Err: cause}
+	ipsm.undo(journal, applyErr)
+
+	return applyErr
+}
+
+// undo undoes the set journal in the reverse order and adds the result to the applyErr
+func (ipsm *IPSetManager) undo(journal *setJournal, applyErr *ApplyError) {
+	rollbackErrs := []error{applyErr.RollbackErr}
+	for idx := len(journal.operations) - 1; idx >= 0; idx-- {
+		op := journal.operations[idx]
+
+		var err error
+		switch op.operation {
+		case operationCreateSet:
+			_, err = ipsm.run(nil, "destroy", op.set.Name)
+		case operationSwapSet, operationDestroySet:
+			_, err = ipsm.run(strings.NewReader(ipsetRestoreScript(op.set)), "restore")
+		case operationPlaceSetRule:
+			err = ipsm.wrapper.Delete(IptablesTableFilter, IptablesChainInput, op.rulespec...)
+		case operationDeleteSetRule:
+			err = ipsm.wrapper.Insert(IptablesTableFilter, IptablesChainInput, op.position, op.rulespec...)
+		}
+
+		if err != nil {
+			rollbackErrs = append(rollbackErrs, fmt.Errorf("failed to undo %s of the %s set: %w", op.operation, op.set.Name, err))
+			continue
+		}
+		applyErr.RolledBack++
+	}
+
+	applyErr.RollbackErr = errors.Join(rollbackErrs...)
+}
+
+// RevertSets undoes the last successful ExecuteSets when the rules applied after the sets failed, so sets and
+// rules are rolled back together. Operations undone by both are counted in the returned *ApplyError.
+func (ipsm *IPSetManager) RevertSets(cause error) error {
+	journal := ipsm.applied
+	ipsm.applied = nil
+	if journal == nil {
+		return cause
+	}
+
+	applyErr := &ApplyError{}
+	if !errors.As(cause, &applyErr) {
+		applyErr = &ApplyError{Err: cause}
+	}
+	ipsm.undo(journal, applyErr)
+
+	return applyErr
+}
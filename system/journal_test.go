@@ -0,0 +1,124 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteRulesRollback(t *testing.T) {
+	existing := []FirewallRule{
+		{IP: "10.10.10.1", Port: NodeExporterPort},
+		{IP: "10.10.10.2", Port: NodeExporterPort},
+	}
+	newRules := []FirewallRule{
+		{IP: "10.10.10.3", Port: NodeExporterPort},
+		{IP: "10.10.10.4", Port: NodeExporterPort},
+		{IP: "10.10.10.5", Port: NodeExporterPort},
+	}
+
+	prepareFake := func() *fakeIPTables {
+		fake := &fakeIPTables{}
+		for _, rule := range existing {
+			fake.rules = append(fake.rules, fakeRule(IptablesChainInput, ruleSpec(rule)))
+		}
+		fake.rules = append(fake.rules, "-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT")
+
+		return fake
+	}
+
+	t.Run("Restore ruleset when append fails", func(t *testing.T) {
+		fake := prepareFake()
+		before := append([]string{}, fake.rules...)
+		fake.failOn = func(operation string, rule string) error {
+			if operation == "append" && strings.Contains(rule, "10.10.10.5") {
+				return fmt.Errorf("iptables: resource temporarily unavailable")
+			}
+			return nil
+		}
+
+		fwm := &FirewallManager{wrapper: fake}
+		err := fwm.ExecuteRules(Plan{Add: newRules, Delete: existing})
+
+		applyErr := &ApplyError{}
+		assert.True(t, errors.As(err, &applyErr))
+		assert.True(t, applyErr.Restored())
+		// 2 deletes and 2 appends were undone
+		assert.Equal(t, 4, applyErr.RolledBack)
+		assert.Contains(t, err.Error(), "restored to its pre-run ruleset")
+		// deleted rules are back at their original positions
+		assert.Equal(t, before, fake.rules)
+	})
+
+	t.Run("Restore positions of multiple deleted rules", func(t *testing.T) {
+		fake := prepareFake()
+		fake.rules = append(fake.rules, fakeRule(IptablesChainInput, ruleSpec(newRules[0])))
+		before := append([]string{}, fake.rules...)
+		fake.failOn = func(operation string, rule string) error {
+			if operation == "append" {
+				return fmt.Errorf("iptables: resource temporarily unavailable")
+			}
+			return nil
+		}
+
+		fwm := &FirewallManager{wrapper: fake}
+		err := fwm.ExecuteRules(Plan{Add: newRules[1:], Delete: []FirewallRule{existing[0], newRules[0]}})
+
+		applyErr := &ApplyError{}
+		assert.True(t, errors.As(err, &applyErr))
+		assert.Equal(t, 2, applyErr.RolledBack)
+		assert.Equal(t, before, fake.rules)
+		// positions of all deleted rules come from a single listing
+		assert.Equal(t, 1, fake.lists)
+	})
+
+	t.Run("Keep rules existing before the run", func(t *testing.T) {
+		fake := prepareFake()
+		before := append([]string{}, fake.rules...)
+		fake.failOn = func(operation string, rule string) error {
+			if operation == "append" && strings.Contains(rule, "10.10.10.5") {
+				return fmt.Errorf("iptables: resource temporarily unavailable")
+			}
+			return nil
+		}
+
+		fwm := &FirewallManager{wrapper: fake}
+		err := fwm.ExecuteRules(Plan{Add: append([]FirewallRule{existing[1]}, newRules...)})
+
+		applyErr := &ApplyError{}
+		assert.True(t, errors.As(err, &applyErr))
+		assert.True(t, applyErr.Restored())
+		// the already existing rule was not appended so it is not undone
+		assert.Equal(t, 2, applyErr.RolledBack)
+		assert.Equal(t, before, fake.rules)
+	})
+
+	t.Run("Report failed rollback", func(t *testing.T) {
+		fake := prepareFake()
+		fake.failOn = func(operation string, rule string) error {
+			if operation == "append" || operation == "insert" {
+				return fmt.Errorf("iptables: resource temporarily unavailable")
+			}
+			return nil
+		}
+
+		fwm := &FirewallManager{wrapper: fake}
+		err := fwm.ExecuteRules(Plan{Add: newRules, Delete: existing})
+
+		applyErr := &ApplyError{}
+		assert.True(t, errors.As(err, &applyErr))
+		assert.False(t, applyErr.Restored())
+		assert.Contains(t, err.Error(), "partially applied ruleset")
+	})
+
+	t.Run("Apply without errors", func(t *testing.T) {
+		fake := prepareFake()
+		fwm := &FirewallManager{wrapper: fake}
+
+		assert.NoError(t, fwm.ExecuteRules(Plan{Add: newRules, Delete: existing}))
+		assert.Len(t, fake.rules, 4)
+	})
+}
@@ -0,0 +1,282 @@
+package system
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portRange is a single port when from == to, or an inclusive range like `1000:2000`
+type portRange struct {
+	from int
+	to   int
+}
+
+func (p portRange) String() string {
+	if p.from == p.to {
+		return strconv.Itoa(p.from)
+	}
+
+	return fmt.Sprintf("%d:%d", p.from, p.to)
+}
+
+// iptablesRule is the structured form of a single line of the `iptables -S` or `iptables-save` output.
+type iptablesRule struct {
+	chain        string
+	proto        string
+	source       string
+	destination  string
+	inInterface  string
+	outInterface string
+	srcPorts     []portRange
+	dstPorts     []portRange
+	matches      []string
+	// matchSet and matchSetFlags come from the `--match-set <name> <flags>` option of the set match
+	matchSet      string
+	matchSetFlags string
+	comment       string
+	target        string
+	// negated keeps names of the fields preceded by the `!`, e.g: `! -s 10.0.0.1` -> `source`
+	negated []string
+	// unknown keeps options and values the parser does not understand, in the original order
+	unknown []string
+}
+
+// isNegated checks if the given field was preceded by the `!`
+func (r *iptablesRule) isNegated(field string) bool {
+	for _, negatedField := range r.negated {
+		if negatedField == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// singleDstPort returns the destination port when rule matches exactly one port
+func (r *iptablesRule) singleDstPort() (int, bool) {
+	if len(r.dstPorts) != 1 || r.dstPorts[0].from != r.dstPorts[0].to || r.isNegated("dstPorts") {
+		return 0, false
+	}
+
+	return r.dstPorts[0].from, true
+}
+
+// parseRule parses rule in the `iptables -S` format, e.g:
+//
+//	-A INPUT -s 10.10.0.18/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT
+func parseRule(rule string) (*iptablesRule, error) {
+	tokens, err := tokenizeRule(rule)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize rule: %w", err)
+	}
+
+	result := &iptablesRule{}
+	negateNext := false
+
+	for idx := 0; idx < len(tokens); idx++ {
+		token := tokens[idx]
+
+		if token == "!" {
+			negateNext = true
+			continue
+		}
+
+		// value returns argument of the current option
+		value := func() (string, error) {
+			if idx+1 >= len(tokens) {
+				return "", fmt.Errorf("missing value for the %s option", token)
+			}
+			idx++
+
+			return tokens[idx], nil
+		}
+
+		field := ""
+		switch token {
+		case "-A", "--append":
+			result.chain, err = value()
+		case "-p", "--protocol":
+			field = "proto"
+			result.proto, err = value()
+		case "-s", "--source", "--src":
+			field = "source"
+			result.source, err = value()
+		case "-d", "--destination", "--dst":
+			field = "destination"
+			result.destination, err = value()
+		case "-i", "--in-interface":
+			field = "inInterface"
+			result.inInterface, err = value()
+		case "-o", "--out-interface":
+			field = "outInterface"
+			result.outInterface, err = value()
+		case "--dport", "--destination-port", "--dports", "--destination-ports":
+			field = "dstPorts"
+			result.dstPorts, err = parsePortList(value())
+		case "--sport", "--source-port", "--sports", "--source-ports":
+			field = "srcPorts"
+			result.srcPorts, err = parsePortList(value())
+		case "-m", "--match":
+			var match string
+			match, err = value()
+			result.matches = append(result.matches, match)
+		case "--match-set":
+			field = "matchSet"
+			result.matchSet, err = value()
+			if err == nil {
+				result.matchSetFlags, err = value()
+			}
+		case "--comment":
+			result.comment, err = value()
+		case "-j", "--jump":
+			result.target, err = value()
+		case "-c", "--set-counters":
+			// packet and byte counters are irrelevant
+			_, err = value()
+			if err == nil {
+				_, err = value()
+			}
+		default:
+			if negateNext {
+				result.unknown = append(result.unknown, "!")
+			}
+			result.unknown = append(result.unknown, token)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if negateNext && field != "" {
+			result.negated = append(result.negated, field)
+		}
+		negateNext = false
+	}
+
+	return result, nil
+}
+
+// parsePortList parses ports in the `--dport` and multiport `--dports` formats, e.g: `80`, `1000:2000`, `80,443,8000:8080`
+func parsePortList(list string, err error) ([]portRange, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	result := []portRange{}
+	for _, item := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(item, ":")
+
+		fromPort, err := parsePort(from, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse port(%s): %w", item, err)
+		}
+
+		toPort := fromPort
+		if isRange {
+			toPort, err = parsePort(to, 65535)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse port(%s): %w", item, err)
+			}
+		}
+
+		result = append(result, portRange{from: fromPort, to: toPort})
+	}
+
+	return result, nil
+}
+
+// parsePort parses a single port, empty port means open range boundary, e.g: `:1024`
+func parsePort(port string, emptyValue int) (int, error) {
+	if port == "" {
+		return emptyValue, nil
+	}
+
+	result, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, err
+	}
+	if result < 0 || result > 65535 {
+		return 0, fmt.Errorf("port out of range")
+	}
+
+	return result, nil
+}
+
+// tokenizeRule splits rule into arguments with the shell-style quoting used by iptables:
+// double quotes with backslash escapes, single quotes and backslash escapes outside the quotes.
+func tokenizeRule(rule string) ([]string, error) {
+	tokens := []string{}
+	current := &strings.Builder{}
+	inToken := false
+
+	for idx := 0; idx < len(rule); idx++ {
+		char := rule[idx]
+
+		switch {
+		case char == ' ' || char == '\t' || char == '\n' || char == '\r':
+			if inToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				inToken = false
+			}
+
+		case char == '\\':
+			if idx+1 >= len(rule) {
+				return nil, fmt.Errorf("unfinished escape sequence at the end of the rule")
+			}
+			idx++
+			current.WriteByte(rule[idx])
+			inToken = true
+
+		case char == '"':
+			end := idx + 1
+			for ; end < len(rule) && rule[end] != '"'; end++ {
+				if rule[end] == '\\' && end+1 < len(rule) {
+					end++
+				}
+				current.WriteByte(rule[end])
+			}
+			if end >= len(rule) {
+				return nil, fmt.Errorf("unterminated double quote at position %d", idx)
+			}
+			idx = end
+			inToken = true
+
+		case char == '\'':
+			end := strings.IndexByte(rule[idx+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote at position %d", idx)
+			}
+			current.WriteString(rule[idx+1 : idx+1+end])
+			idx += end + 1
+			inToken = true
+
+		default:
+			current.WriteByte(char)
+			inToken = true
+		}
+	}
+
+	if inToken {
+		tokens = append(tokens, current.String())
+	}
+
+	return tokens, nil
+}
+
+// joinRuleTokens is reverse of the tokenizeRule. Tokens are quoted the same way iptables quotes them.
+func joinRuleTokens(tokens []string) string {
+	result := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if token != "" && !strings.ContainsAny(token, " \t\n\r\"'\\") {
+			result = append(result, token)
+			continue
+		}
+
+		escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(token)
+		result = append(result, `"`+escaped+`"`)
+	}
+
+	return strings.Join(result, " ")
+}
@@ -0,0 +1,203 @@
+package system
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRule(t *testing.T) {
+	t.Run("Parse tcp", func(t *testing.T) {
+		expected := &iptablesRule{
+			chain:    "INPUT",
+			proto:    "tcp",
+			matches:  []string{"tcp"},
+			dstPorts: []portRange{{from: 80, to: 80}},
+			comment:  "",
+			target:   "ACCEPT",
+		}
+		res, err := parseRule("-A INPUT -p tcp -m tcp --dport 80 -c 0 0 -j ACCEPT")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res)
+	})
+
+	t.Run("Parse tcp invalid port", func(t *testing.T) {
+		res, err := parseRule("-A INPUT -p tcp -m tcp --dport 2h2 -c 0 0 -j ACCEPT")
+		assert.Nil(t, res)
+		assert.Error(t, err)
+	})
+
+	t.Run("Parse tcp with comment", func(t *testing.T) {
+		expected := &iptablesRule{
+			chain:    "INPUT",
+			proto:    "tcp",
+			matches:  []string{"tcp", "comment"},
+			dstPorts: []portRange{{from: 80, to: 80}},
+			comment:  "FW-MANAGER RULE",
+			target:   "ACCEPT",
+		}
+		res, err := parseRule(`-A INPUT -p tcp -m tcp --dport 80 -m comment --comment "FW-MANAGER RULE" -c 0 0 -j ACCEPT`)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res)
+	})
+
+	t.Run("Parse tcp with comment and source", func(t *testing.T) {
+		expected := &iptablesRule{
+			chain:    "INPUT",
+			proto:    "tcp",
+			matches:  []string{"tcp", "comment"},
+			dstPorts: []portRange{{from: 9100, to: 9100}},
+			source:   "10.10.0.18/32",
+			comment:  "FW-MANAGER RULE",
+			target:   "ACCEPT",
+		}
+		res, err := parseRule(`-A INPUT -s 10.10.0.18/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res)
+	})
+
+	t.Run("Parse port range and multiport", func(t *testing.T) {
+		res, err := parseRule(`-A INPUT -p tcp -m multiport --dports 80,443,8000:8080 --sport 1024: -j ACCEPT`)
+		assert.NoError(t, err)
+		assert.Equal(t, []portRange{{80, 80}, {443, 443}, {8000, 8080}}, res.dstPorts)
+		assert.Equal(t, []portRange{{1024, 65535}}, res.srcPorts)
+
+		_, single := res.singleDstPort()
+		assert.False(t, single)
+	})
+
+	t.Run("Parse negation and interfaces", func(t *testing.T) {
+		expected := &iptablesRule{
+			chain:        "DOCKER",
+			proto:        "tcp",
+			destination:  "172.17.0.2/32",
+			inInterface:  "docker0",
+			outInterface: "docker0",
+			matches:      []string{"tcp"},
+			dstPorts:     []portRange{{from: 5432, to: 5432}},
+			target:       "ACCEPT",
+			negated:      []string{"inInterface"},
+		}
+		res, err := parseRule(`-A DOCKER -d 172.17.0.2/32 ! -i docker0 -o docker0 -p tcp -m tcp --dport 5432 -j ACCEPT`)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res)
+		assert.True(t, res.isNegated("inInterface"))
+		assert.False(t, res.isNegated("outInterface"))
+	})
+
+	t.Run("Parse match set", func(t *testing.T) {
+		expected := &iptablesRule{
+			chain:         "INPUT",
+			proto:         "tcp",
+			inInterface:   "wg0",
+			matches:       []string{"tcp", "set", "comment"},
+			dstPorts:      []portRange{{from: 9100, to: 9100}},
+			matchSet:      "fwm-tcp-9100",
+			matchSetFlags: "src",
+			comment:       "FW-MANAGER SET",
+			target:        "ACCEPT",
+		}
+		res, err := parseRule(`-A INPUT -i wg0 -p tcp -m tcp --dport 9100 -m set --match-set fwm-tcp-9100 src -m comment --comment "FW-MANAGER SET" -j ACCEPT`)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res)
+
+		_, err = parseRule(`-A INPUT -m set --match-set fwm-tcp-9100`)
+		assert.Error(t, err)
+	})
+
+	t.Run("Keep unknown options", func(t *testing.T) {
+		res, err := parseRule(`-A INPUT -m conntrack ! --ctstate INVALID -j REJECT --reject-with icmp-port-unreachable`)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"!", "--ctstate", "INVALID", "--reject-with", "icmp-port-unreachable"}, res.unknown)
+	})
+
+	t.Run("Parse missing value", func(t *testing.T) {
+		res, err := parseRule(`-A INPUT -j`)
+		assert.Nil(t, res)
+		assert.Error(t, err)
+	})
+}
+
+func TestTokenizeRule(t *testing.T) {
+	testCases := []struct {
+		rule     string
+		expected []string
+		hasError bool
+	}{
+		{rule: `-A INPUT -j ACCEPT`, expected: []string{"-A", "INPUT", "-j", "ACCEPT"}},
+		{rule: `  -A   INPUT  `, expected: []string{"-A", "INPUT"}},
+		{rule: `--comment "FW-MANAGER RULE"`, expected: []string{"--comment", "FW-MANAGER RULE"}},
+		{rule: `--comment 'single quoted'`, expected: []string{"--comment", "single quoted"}},
+		{rule: `--comment "it's \"quoted\" \\ here"`, expected: []string{"--comment", `it's "quoted" \ here`}},
+		{rule: `--comment escaped\ space`, expected: []string{"--comment", "escaped space"}},
+		{rule: `--comment ""`, expected: []string{"--comment", ""}},
+		{rule: `--comment "unterminated`, hasError: true},
+		{rule: `--comment 'unterminated`, hasError: true},
+		{rule: `--comment \`, hasError: true},
+	}
+
+	for _, tc := range testCases {
+		res, err := tokenizeRule(tc.rule)
+		if tc.hasError {
+			assert.Error(t, err, tc.rule)
+			continue
+		}
+
+		assert.NoError(t, err, tc.rule)
+		assert.Equal(t, tc.expected, res, tc.rule)
+	}
+}
+
+func TestParseIptablesSaveSample(t *testing.T) {
+	for _, rule := range iptablesSaveSampleRules(t) {
+		_, err := parseRule(rule)
+		assert.NoError(t, err, rule)
+	}
+}
+
+func FuzzParseRule(f *testing.F) {
+	for _, rule := range iptablesSaveSampleRules(f) {
+		f.Add(rule)
+	}
+
+	f.Fuzz(func(t *testing.T, rule string) {
+		// parser must never panic, errors are fine
+		_, _ = parseRule(rule)
+
+		tokens, err := tokenizeRule(rule)
+		if err != nil {
+			return
+		}
+
+		// quoting tokens back must give the same tokens
+		roundTrip, err := tokenizeRule(joinRuleTokens(tokens))
+		if err != nil {
+			t.Fatalf("failed to tokenize joined tokens of %q: %s", rule, err)
+		}
+		if strings.Join(roundTrip, "\x00") != strings.Join(tokens, "\x00") {
+			t.Fatalf("tokens differ after round trip of %q: %q != %q", rule, roundTrip, tokens)
+		}
+	})
+}
+
+// iptablesSaveSampleRules returns rules from the real iptables-save output, tables, chains and comments are skipped
+func iptablesSaveSampleRules(tb testing.TB) []string {
+	file, err := os.Open("testdata/iptables-save.txt")
+	if err != nil {
+		tb.Fatal("failed to open iptables-save sample", err)
+	}
+	defer file.Close()
+
+	rules := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "-A ") {
+			rules = append(rules, scanner.Text())
+		}
+	}
+
+	return rules
+}
@@ -0,0 +1,252 @@
+package system
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type PlacementMode string
+
+const (
+	// PlacementAppend puts managed rules at the end of the chain
+	PlacementAppend PlacementMode = "append"
+	// PlacementTop puts managed rules before all other rules
+	PlacementTop PlacementMode = "top"
+	// PlacementBefore puts managed rules before the first rule matching the pattern
+	PlacementBefore PlacementMode = "before"
+	// PlacementAfter puts managed rules right after the anchor rule, the rule with the anchor comment
+	PlacementAfter PlacementMode = "after"
+)
+
+// RulePlacement describes where managed rules are located in the INPUT chain.
+type RulePlacement struct {
+	Mode    PlacementMode
+	Pattern *regexp.Regexp
+	Anchor  string
+}
+
+// ParseRulePlacement parses placement in one of the formats:
+// `append`, `top`, `before:<regexp matching iptables -S rule>`, `after:<anchor rule comment>`
+func ParseRulePlacement(value string) (RulePlacement, error) {
+	mode, arg, _ := strings.Cut(value, ":")
+
+	switch PlacementMode(mode) {
+	case PlacementAppend, PlacementTop:
+		if arg != "" {
+			return RulePlacement{}, fmt.Errorf("placement %s does not take an argument", mode)
+		}
+		return RulePlacement{Mode: PlacementMode(mode)}, nil
+
+	case PlacementBefore:
+		if arg == "" {
+			return RulePlacement{}, fmt.Errorf("missing pattern for the %s placement", mode)
+		}
+		pattern, err := regexp.Compile(arg)
+		if err != nil {
+			return RulePlacement{}, fmt.Errorf("failed to compile placement pattern: %w", err)
+		}
+		return RulePlacement{Mode: PlacementBefore, Pattern: pattern}, nil
+
+	case PlacementAfter:
+		if arg == "" {
+			return RulePlacement{}, fmt.Errorf("missing anchor for the %s placement", mode)
+		}
+		return RulePlacement{Mode: PlacementAfter, Anchor: arg}, nil
+	}
+
+	return RulePlacement{}, fmt.Errorf("unknown placement %q, expected one of: append, top, before:<pattern>, after:<anchor>", value)
+}
+
+func (p RulePlacement) String() string {
+	switch p.Mode {
+	case PlacementBefore:
+		return fmt.Sprintf("%s:%s", p.Mode, p.Pattern)
+	case PlacementAfter:
+		return fmt.Sprintf("%s:%s", p.Mode, p.Anchor)
+	case "":
+		return string(PlacementAppend)
+	}
+
+	return string(p.Mode)
+}
+
+// chainRule is a single rule listed from the chain. Rules which could not be parsed have nil parsed field.
+type chainRule struct {
+	raw     string
+	parsed  *iptablesRule
+	managed bool
+}
+
+// listChainRules lists rules of the INPUT chain in their order, policies and chain definitions are skipped
+func listChainRules(wrapper iptablesWrapper) ([]chainRule, error) {
+	rawRules, err := wrapper.List(IptablesTableFilter, IptablesChainInput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list all iptables rules: %w", err)
+	}
+
+	result := []chainRule{}
+	for _, rawRule := range rawRules {
+		if !strings.HasPrefix(rawRule, "-A ") {
+			continue
+		}
+
+		rule := chainRule{raw: rawRule}
+		if parsed, err := parseRule(rawRule); err == nil {
+			rule.parsed = parsed
+			rule.managed = parsed.comment == ManagedComment || parsed.comment == ManagedSetComment
+		}
+
+		result = append(result, rule)
+	}
+
+	return result, nil
+}
+
+// bounds returns the range of indexes in the rules where the managed rules may be located.
+func (p RulePlacement) bounds(rules []chainRule) (int, int, error) {
+	lower, upper := 0, len(rules)-1
+
+	switch p.Mode {
+	case PlacementTop:
+		if idx := p.firstUnmanaged(rules, 0, nil); idx >= 0 {
+			upper = idx - 1
+		}
+
+	case PlacementBefore:
+		if idx := p.firstUnmanaged(rules, 0, p.matchesPattern); idx >= 0 {
+			upper = idx - 1
+		}
+
+	case PlacementAfter:
+		anchor := p.firstUnmanaged(rules, 0, p.isAnchor)
+		if anchor < 0 {
+			return 0, 0, fmt.Errorf("anchor rule with the %q comment not found in the %s chain", p.Anchor, IptablesChainInput)
+		}
+		lower = anchor + 1
+		if idx := p.firstUnmanaged(rules, anchor+1, nil); idx >= 0 {
+			upper = idx - 1
+		}
+	}
+
+	return lower, upper, nil
+}
+
+// insertPosition returns the iptables position (1-based) for the new managed rule, 0 means the rule is appended
+func (p RulePlacement) insertPosition(rules []chainRule) (int, error) {
+	switch p.Mode {
+	case PlacementTop:
+		return 1, nil
+
+	case PlacementBefore:
+		if idx := p.firstUnmanaged(rules, 0, p.matchesPattern); idx >= 0 {
+			return idx + 1, nil
+		}
+
+	case PlacementAfter:
+		anchor := p.firstUnmanaged(rules, 0, p.isAnchor)
+		if anchor < 0 {
+			return 0, fmt.Errorf("anchor rule with the %q comment not found in the %s chain", p.Anchor, IptablesChainInput)
+		}
+		return anchor + 2, nil
+	}
+
+	return 0, nil
+}
+
+// misplacement describes why the managed rule at idx is misplaced, empty string means rule is placed correctly
+func (p RulePlacement) misplacement(idx, lower, upper int) string {
+	if idx >= lower && idx <= upper {
+		return ""
+	}
+
+	return fmt.Sprintf("rule is at position %d, expected position between %d and %d for the %s placement", idx+1, lower+1, upper+1, p)
+}
+
+func (p RulePlacement) firstUnmanaged(rules []chainRule, from int, match func(chainRule) bool) int {
+	for idx := from; idx < len(rules); idx++ {
+		if rules[idx].managed {
+			continue
+		}
+		if match == nil || match(rules[idx]) {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+func (p RulePlacement) matchesPattern(rule chainRule) bool {
+	return p.Pattern != nil && p.Pattern.MatchString(rule.raw)
+}
+
+func (p RulePlacement) isAnchor(rule chainRule) bool {
+	return rule.parsed != nil && rule.parsed.comment == p.Anchor
+}
+
+// placementPosition lists the chain and returns the position for new managed rules, 0 means rules are appended.
+// Inserting many rules at the consecutive positions keeps all of them in the required place.
+func placementPosition(wrapper iptablesWrapper, placement RulePlacement) (int, error) {
+	if placement.Mode == PlacementAppend || placement.Mode == "" {
+		return 0, nil
+	}
+
+	rules, err := listChainRules(wrapper)
+	if err != nil {
+		return 0, err
+	}
+
+	return placement.insertPosition(rules)
+}
+
+// placeRule adds rule at the position returned by the placementPosition. It reports false when
+// the rule to append already exists and the chain was left untouched.
+func placeRule(wrapper iptablesWrapper, position int, rulespec []string) (bool, error) {
+	if position == 0 {
+		exists, err := wrapper.Exists(IptablesTableFilter, IptablesChainInput, rulespec...)
+		if err != nil {
+			return false, fmt.Errorf("failed to check if rule exists: %w", err)
+		}
+		if exists {
+			return false, nil
+		}
+
+		return true, wrapper.AppendUnique(IptablesTableFilter, IptablesChainInput, rulespec...)
+	}
+
+	return true, wrapper.Insert(IptablesTableFilter, IptablesChainInput, position, rulespec...)
+}
+
+// rulePositions tracks positions of the chain rules while they are deleted, so the chain is listed
+// once for all the deletes of the run
+type rulePositions struct {
+	// specs are rules of the chain in the chain order, joined with the joinRuleTokens
+	specs []string
+}
+
+func listRulePositions(wrapper iptablesWrapper) (*rulePositions, error) {
+	rules, err := listChainRules(wrapper)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := &rulePositions{specs: make([]string, 0, len(rules))}
+	for _, rule := range rules {
+		positions.specs = append(positions.specs, joinRuleTokens(rawRuleSpec(rule.raw)))
+	}
+
+	return positions, nil
+}
+
+// deleted returns the 1-based position of the deleted rule and moves the following rules one position up.
+// Like the iptables, the first matching rule is deleted. 0 is returned when the rule is not in the chain.
+func (positions *rulePositions) deleted(rulespec []string) int {
+	idx := slices.Index(positions.specs, joinRuleTokens(rulespec))
+	if idx < 0 {
+		return 0
+	}
+	positions.specs = slices.Delete(positions.specs, idx, idx+1)
+
+	return idx + 1
+}
@@ -0,0 +1,112 @@
+package system
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRulePlacement(t *testing.T) {
+	for _, value := range []string{"append", "top", "before:-j REJECT", "after:FW-MANAGER ANCHOR"} {
+		placement, err := ParseRulePlacement(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, value, placement.String())
+	}
+
+	for _, value := range []string{"", "bottom", "top:1", "before:", "before:[", "after:"} {
+		_, err := ParseRulePlacement(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRulePlacement(t *testing.T) {
+	const (
+		acceptSSH    = `-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT`
+		anchor       = `-A INPUT -m comment --comment "FW-MANAGER ANCHOR" -j RETURN`
+		rejectAll    = `-A INPUT -j REJECT --reject-with icmp-port-unreachable`
+		managed17    = `-A INPUT -s 10.10.0.17/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`
+		managed18    = `-A INPUT -s 10.10.0.18/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`
+		managed19    = `-A INPUT -s 10.10.0.19/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`
+		placementTop = "top"
+	)
+
+	testCases := []struct {
+		name      string
+		placement string
+		rules     []string
+		drifted   []RuleIP
+		expected  []string
+	}{
+		{
+			name:      "Append after catch-all is not checked",
+			placement: "append",
+			rules:     []string{acceptSSH, rejectAll, managed17, managed18},
+			expected:  []string{acceptSSH, rejectAll, managed17, managed19},
+		},
+		{
+			name:      "Move rules to the top",
+			placement: placementTop,
+			rules:     []string{managed17, acceptSSH, rejectAll, managed18},
+			drifted:   []RuleIP{"10.10.0.18"},
+			expected:  []string{managed19, managed17, acceptSSH, rejectAll},
+		},
+		{
+			name:      "Move rules before the catch-all",
+			placement: "before:-j REJECT",
+			rules:     []string{acceptSSH, managed17, rejectAll, managed18},
+			drifted:   []RuleIP{"10.10.0.18"},
+			expected:  []string{acceptSSH, managed17, managed19, rejectAll},
+		},
+		{
+			name:      "Move rules after the anchor",
+			placement: "after:FW-MANAGER ANCHOR",
+			rules:     []string{managed18, acceptSSH, anchor, managed17, rejectAll},
+			drifted:   []RuleIP{"10.10.0.18"},
+			expected:  []string{acceptSSH, anchor, managed19, managed17, rejectAll},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			placement, err := ParseRulePlacement(tc.placement)
+			assert.NoError(t, err)
+
+			fake := &fakeIPTables{rules: tc.rules}
+			fwm := &FirewallManager{wrapper: fake}
+			fwm.SetPlacement(placement)
+
+			existing, err := fwm.ListManagedFirewallRules()
+			assert.NoError(t, err)
+
+			drifted := []RuleIP{}
+			for _, event := range DriftEvents(existing) {
+				drifted = append(drifted, event.Rule.IP)
+			}
+			assert.ElementsMatch(t, tc.drifted, drifted)
+
+			plan := PrepareRulesExecutionPlan(existing, []FirewallRule{
+				{IP: "10.10.0.17", Port: NodeExporterPort},
+				{IP: "10.10.0.19", Port: NodeExporterPort},
+			})
+			assert.NoError(t, fwm.ExecuteRules(plan))
+
+			// 10.10.0.18 is not desired anymore, it is deleted even when drifted
+			assert.Equal(t, tc.expected, fake.rules)
+
+			existing, err = fwm.ListManagedFirewallRules()
+			assert.NoError(t, err)
+			assert.Empty(t, DriftEvents(existing))
+		})
+	}
+
+	t.Run("Missing anchor", func(t *testing.T) {
+		placement, err := ParseRulePlacement("after:FW-MANAGER ANCHOR")
+		assert.NoError(t, err)
+
+		fwm := &FirewallManager{wrapper: &fakeIPTables{rules: []string{acceptSSH, managed17}}}
+		fwm.SetPlacement(placement)
+
+		_, err = fwm.ListManagedFirewallRules()
+		assert.ErrorContains(t, err, "anchor rule")
+	})
+}
@@ -0,0 +1,138 @@
+package system
+
+import (
+	"fmt"
+	"slices"
+)
+
+// RuleKey identifies the rule by everything fw-manager sets in the rule
+type RuleKey struct {
+	IP        RuleIP
+	Port      RulePort
+	Interface string
+}
+
+// Key returns the identity of the rule
+func (rule FirewallRule) Key() RuleKey {
+	return RuleKey{IP: rule.IP, Port: rule.Port, Interface: rule.Interface}
+}
+
+// Plan is the change which turns the existing managed rules into the desired rules
+type Plan struct {
+	Add    []FirewallRule
+	Delete []FirewallRule
+	// Unchanged are existing rules which are kept as they are
+	Unchanged []FirewallRule
+	// Drifted are existing rules modified outside of the fw-manager, they are deleted as well
+	Drifted []FirewallRule
+	Stats   PlanStats
+}
+
+type PlanStats struct {
+	Add       int
+	Delete    int
+	Unchanged int
+	Drifted   int
+	// Duplicates is the number of repeated desired rules and repeated existing rules
+	Duplicates int
+}
+
+func (stats PlanStats) String() string {
+	return fmt.Sprintf(
+		"%d to add, %d to delete, %d unchanged, %d drifted, %d duplicates",
+		stats.Add, stats.Delete, stats.Unchanged, stats.Drifted, stats.Duplicates,
+	)
+}
+
+// Empty checks if the plan changes nothing
+func (plan Plan) Empty() bool {
+	return len(plan.Add) == 0 && len(plan.Delete) == 0
+}
+
+func newPlan() Plan {
+	return Plan{
+		Add:       []FirewallRule{},
+		Delete:    []FirewallRule{},
+		Unchanged: []FirewallRule{},
+		Drifted:   []FirewallRule{},
+	}
+}
+
+func (plan *Plan) countStats(duplicates int) {
+	plan.Stats = PlanStats{
+		Add:        len(plan.Add),
+		Delete:     len(plan.Delete),
+		Unchanged:  len(plan.Unchanged),
+		Drifted:    len(plan.Drifted),
+		Duplicates: duplicates,
+	}
+}
+
+// PrepareRulesExecutionPlan compares existing and desired rules by their keys.
+//   - Drifted existing rules are always deleted and never satisfy the desired rule, so they get replaced.
+//   - Existing rule bound to other interface than the desired rule for the same source and port is drifted.
+//   - Only the first existing rule with given key is kept, repeated rules are deleted.
+//   - Repeated desired rules are added once.
+func PrepareRulesExecutionPlan(existingRules []FirewallRule, desiredRules []FirewallRule) Plan {
+	plan := newPlan()
+	duplicates := 0
+
+	desired := make(map[RuleKey]bool, len(desiredRules))
+	// desiredInterfaces keeps the interface of the desired rule for the source and port
+	desiredInterfaces := make(map[RuleKey]string, len(desiredRules))
+	for _, rule := range desiredRules {
+		desired[rule.Key()] = true
+		desiredInterfaces[RuleKey{IP: rule.IP, Port: rule.Port}] = rule.Interface
+	}
+
+	kept := make(map[RuleKey]bool, len(existingRules))
+	for _, rule := range existingRules {
+		key := rule.Key()
+		switch {
+		case rule.Drifted():
+			plan.Drifted = append(plan.Drifted, rule)
+			plan.Delete = append(plan.Delete, rule)
+		case kept[key]:
+			duplicates++
+			plan.Delete = append(plan.Delete, rule)
+		case desired[key]:
+			kept[key] = true
+			plan.Unchanged = append(plan.Unchanged, rule)
+		case interfaceDrift(rule, desiredInterfaces) != "":
+			rule.Drift = append(slices.Clone(rule.Drift), interfaceDrift(rule, desiredInterfaces))
+			plan.Drifted = append(plan.Drifted, rule)
+			plan.Delete = append(plan.Delete, rule)
+		default:
+			plan.Delete = append(plan.Delete, rule)
+		}
+	}
+
+	added := make(map[RuleKey]bool, len(desiredRules))
+	for _, rule := range desiredRules {
+		key := rule.Key()
+		if added[key] {
+			duplicates++
+			continue
+		}
+		added[key] = true
+
+		if !kept[key] {
+			plan.Add = append(plan.Add, rule)
+		}
+	}
+
+	plan.countStats(duplicates)
+
+	return plan
+}
+
+// interfaceDrift describes the difference between the interface of the existing rule and the desired rule
+// for the same source and port, empty when there is no such desired rule
+func interfaceDrift(rule FirewallRule, desiredInterfaces map[RuleKey]string) string {
+	expected, exists := desiredInterfaces[RuleKey{IP: rule.IP, Port: rule.Port}]
+	if !exists || expected == rule.Interface {
+		return ""
+	}
+
+	return fmt.Sprintf("in interface is %q, expected %q", rule.Interface, expected)
+}
@@ -0,0 +1,61 @@
+package system
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareRulesExecutionPlan(t *testing.T) {
+	existing := []FirewallRule{
+		{IP: "10.10.0.17", Port: NodeExporterPort, RawRule: "first"},
+		{IP: "10.10.0.17", Port: NodeExporterPort, RawRule: "second"},
+		{IP: "10.10.0.18", Port: NodeExporterPort},
+		{IP: "10.10.0.19", Port: NodeExporterPort, Drift: []string{"target"}},
+	}
+	desired := []FirewallRule{
+		{IP: "10.10.0.17", Port: NodeExporterPort},
+		{IP: "10.10.0.19", Port: NodeExporterPort},
+		{IP: "10.10.0.20", Port: NodeExporterPort},
+		{IP: "10.10.0.20", Port: NodeExporterPort},
+	}
+
+	plan := PrepareRulesExecutionPlan(existing, desired)
+	assert.Equal(t, []FirewallRule{existing[0]}, plan.Unchanged)
+	assert.Equal(t, []FirewallRule{existing[1], existing[2], existing[3]}, plan.Delete)
+	assert.Equal(t, []FirewallRule{existing[3]}, plan.Drifted)
+	assert.Equal(t, []FirewallRule{desired[1], desired[2]}, plan.Add)
+	assert.Equal(t, PlanStats{Add: 2, Delete: 3, Unchanged: 1, Drifted: 1, Duplicates: 2}, plan.Stats)
+	assert.False(t, plan.Empty())
+
+	plan = PrepareRulesExecutionPlan(desired[:1], desired[:1])
+	assert.True(t, plan.Empty())
+	assert.Equal(t, "0 to add, 0 to delete, 1 unchanged, 0 drifted, 0 duplicates", plan.Stats.String())
+}
+
+// benchmarkRules returns rules for count peers, 4 ports each
+func benchmarkRules(count int, offset int) []FirewallRule {
+	ports := []RulePort{LogstashPort, NodeExporterPort, MySQLExportedPort, MySQLPort}
+
+	result := make([]FirewallRule, 0, count)
+	for idx := offset; len(result) < count; idx++ {
+		ip := RuleIP(fmt.Sprintf("10.%d.%d.%d", idx/65536%256, idx/256%256, idx%256))
+		result = append(result, FirewallRule{IP: ip, Port: ports[idx%len(ports)], Interface: "wg0"})
+	}
+
+	return result
+}
+
+func BenchmarkPrepareRulesExecutionPlan(b *testing.B) {
+	const fleetRules = 50_000
+
+	// 10% of the fleet changed since the previous run
+	existing := benchmarkRules(fleetRules, 0)
+	desired := benchmarkRules(fleetRules, fleetRules/10)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		PrepareRulesExecutionPlan(existing, desired)
+	}
+}
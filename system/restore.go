@@ -0,0 +1,109 @@
+package system
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// SaveRuleset returns the whole ruleset of all tables in the `iptables-save` format
+func (fwm *FirewallManager) SaveRuleset() (string, error) {
+	if ruleset, offline := fwm.wrapper.(*IptablesSave); offline {
+		result := &strings.Builder{}
+		if _, err := ruleset.WriteTo(result); err != nil {
+			return "", fmt.Errorf("failed to write ruleset: %w", err)
+		}
+
+		return result.String(), nil
+	}
+
+	out, err := exec.Command("iptables-save").Output()
+	if err != nil {
+		return "", fmt.Errorf("iptables-save failed: %w", err)
+	}
+
+	return string(out), nil
+}
+
+// ListRules returns all rules of the INPUT chain in the `iptables -S` format
+func (fwm *FirewallManager) ListRules() ([]string, error) {
+	rawRules, err := fwm.wrapper.List(IptablesTableFilter, IptablesChainInput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list all iptables rules: %w", err)
+	}
+
+	return rawRules, nil
+}
+
+// ParseManagedRules returns managed rules from the rules in the `iptables -S` format, e.g: saved before the change.
+// Rules keep their raw form, so they are restored exactly as they were.
+func ParseManagedRules(rawRules []string) ([]FirewallRule, error) {
+	result := []FirewallRule{}
+	for _, rawRule := range rawRules {
+		if !strings.Contains(rawRule, ManagedComment) {
+			continue
+		}
+
+		rule, err := parseRule(rawRule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rule(%s): %w", rawRule, err)
+		}
+		if rule.comment != ManagedComment {
+			continue
+		}
+
+		port, _ := rule.singleDstPort()
+		result = append(result, FirewallRule{
+			IP:        RuleIP(strings.TrimSuffix(rule.source, "/32")),
+			Port:      RulePort(port),
+			Interface: rule.inInterface,
+			RawRule:   rawRule,
+		})
+	}
+
+	return result, nil
+}
+
+// PrepareRestorePlan compares the current managed rules with the rules to restore by their exact form
+func PrepareRestorePlan(currentRules []FirewallRule, targetRules []FirewallRule) Plan {
+	plan := newPlan()
+	duplicates := 0
+
+	target := make(map[string]bool, len(targetRules))
+	for _, rule := range targetRules {
+		target[joinRuleTokens(ruleSpec(rule))] = true
+	}
+
+	kept := make(map[string]bool, len(currentRules))
+	for _, rule := range currentRules {
+		key := joinRuleTokens(ruleSpec(rule))
+		switch {
+		case kept[key]:
+			duplicates++
+			plan.Delete = append(plan.Delete, rule)
+		case target[key]:
+			kept[key] = true
+			plan.Unchanged = append(plan.Unchanged, rule)
+		default:
+			plan.Delete = append(plan.Delete, rule)
+		}
+	}
+
+	added := make(map[string]bool, len(targetRules))
+	for _, rule := range targetRules {
+		key := joinRuleTokens(ruleSpec(rule))
+		if added[key] {
+			duplicates++
+			continue
+		}
+		added[key] = true
+
+		if !kept[key] {
+			plan.Add = append(plan.Add, rule)
+		}
+	}
+
+	plan.countStats(duplicates)
+
+	return plan
+}
@@ -0,0 +1,49 @@
+package system
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreManagedRules(t *testing.T) {
+	const (
+		acceptSSH = `-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT`
+		managed17 = `-A INPUT -s 10.10.0.17/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`
+		managed18 = `-A INPUT -s 10.10.0.18/32 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`
+		drifted19 = `-A INPUT -s 10.10.0.19/32 -i wg0 -p tcp -m tcp --dport 9100 -m comment --comment "FW-MANAGER RULE" -j ACCEPT`
+	)
+
+	snapshotRules := []string{"-P INPUT ACCEPT", acceptSSH, managed17, drifted19}
+
+	fake := &fakeIPTables{rules: []string{acceptSSH, managed18, managed17}}
+	fwm := &FirewallManager{wrapper: fake}
+
+	currentRules, err := fwm.ListManagedFirewallRules()
+	assert.NoError(t, err)
+
+	targetRules, err := ParseManagedRules(snapshotRules)
+	assert.NoError(t, err)
+	assert.Len(t, targetRules, 2)
+
+	plan := PrepareRestorePlan(currentRules, targetRules)
+	assert.Equal(t, []FirewallRule{currentRules[0]}, plan.Delete)
+	assert.Equal(t, []FirewallRule{targetRules[1]}, plan.Add)
+	assert.Equal(t, []FirewallRule{currentRules[1]}, plan.Unchanged)
+
+	assert.NoError(t, fwm.ExecuteRules(plan))
+	// Rules are restored exactly as they were, including the modifications made by hand
+	assert.Equal(t, []string{acceptSSH, managed17, drifted19}, fake.rules)
+}
+
+func TestSaveRulesetOffline(t *testing.T) {
+	ruleset, err := ReadIptablesSave(strings.NewReader(iptablesSaveSample(t)))
+	assert.NoError(t, err)
+
+	saved, err := NewOfflineFirewallManager(ruleset).SaveRuleset()
+	assert.NoError(t, err)
+	// other chains than INPUT are kept
+	assert.Contains(t, saved, ":FORWARD DROP [0:0]\n")
+	assert.Contains(t, saved, "-A DOCKER-USER -j RETURN\n")
+}
@@ -6,12 +6,21 @@ type (
 	RuleIP       string
 	RulePort     int
 	FirewallRule struct {
-		IP      RuleIP
-		Port    RulePort
-		RawRule string
+		IP   RuleIP
+		Port RulePort
+		// Interface is the input interface the rule is bound to, empty means any interface
+		Interface string
+		RawRule   string
+		// Drift lists differences between the rule in iptables and the rule fw-manager would create
+		Drift []string
 	}
 )
 
+// Drifted checks if rule was modified outside of the fw-manager
+func (rule FirewallRule) Drifted() bool {
+	return len(rule.Drift) > 0
+}
+
 const (
 	LogstashPort      RulePort = 5141
 	NodeExporterPort  RulePort = 9100
@@ -19,6 +28,17 @@ const (
 	MySQLPort         RulePort = 3306
 )
 
+// BindRulesToInterface returns copy of the rules which accept traffic only from the given interface
+func BindRulesToInterface(rules []FirewallRule, iface string) []FirewallRule {
+	result := make([]FirewallRule, 0, len(rules))
+	for _, rule := range rules {
+		rule.Interface = iface
+		result = append(result, rule)
+	}
+
+	return result
+}
+
 // Logic to prepare rules is hardcoded as following:
 //   - 5141 - Logstash rsyslog port on logs.*, required access from ALL hosts.
 //   - 9100 - Node exporter on ALL hosts, required access by metrics.*.
@@ -16,15 +16,38 @@ const (
 	FleetBackups FleetType = "backups"
 )
 
+// FleetTypes are all the known fleet types
+var FleetTypes = []FleetType{FleetLogs, FleetMetrics, FleetApp, FleetBackups}
+
+// ParseFleetType returns the known fleet type with the given name
+func ParseFleetType(name string) (FleetType, error) {
+	for _, fleetType := range FleetTypes {
+		if string(fleetType) == name {
+			return fleetType, nil
+		}
+	}
+
+	return FleetUnknown, fmt.Errorf("unknown fleet type %q, expected one of: %v", name, FleetTypes)
+}
+
 type FleetItem struct {
 	Type    FleetType
 	ID      string
 	Node    string
 	Address string
+	// Service is the name of the consul service the item was registered as
+	Service string
+	// AddressSource tells where the Address was taken from, e.g: service, node, tagged:lan_ipv4 or inventory
+	AddressSource string
 }
 
 type FleetCatalog map[FleetType][]FleetItem
 
+// Add appends the item to the catalog under its type
+func (fleet FleetCatalog) Add(item FleetItem) {
+	fleet[item.Type] = append(fleet[item.Type], item)
+}
+
 func (fleet FleetCatalog) FindItemByIP(ip net.IP) *FleetItem {
 	for fleetType, fleetItems := range fleet {
 		for itemIdx, fleetItem := range fleetItems {